@@ -0,0 +1,288 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type (
+	JobResponse struct {
+		Id string
+	}
+
+	ContainerJobInfo struct {
+		Job       *ContainerJob
+		Instances []*JobInstance
+	}
+
+	MasterInfo struct {
+		Name string
+		Term int64
+	}
+
+	ImageJobInfo struct {
+		Id     string
+		Job    *ImageJob
+		Status map[string]string
+	}
+)
+
+// Registers the hive API handlers
+func (e *Engine) registerApiHandlers() {
+	e.Router.HandleFunc("/hive/master", e.masterHandler).Methods("GET")
+	e.Router.HandleFunc("/hive/nodes", e.nodesHandler).Methods("GET")
+	e.Router.HandleFunc("/hive/nodes/{zone}/{name}/cordon", e.cordonHandler).Methods("POST")
+	e.Router.HandleFunc("/hive/nodes/{zone}/{name}/uncordon", e.uncordonHandler).Methods("POST")
+	e.Router.HandleFunc("/hive/nodes/{zone}/{name}/drain", e.drainHandler).Methods("POST")
+	e.Router.HandleFunc("/hive/jobs/containers", e.listContainerJobsHandler).Methods("GET")
+	e.Router.HandleFunc("/hive/jobs/containers", e.addContainerJobHandler).Methods("POST")
+	e.Router.HandleFunc("/hive/jobs/containers/{id}", e.containerJobHandler).Methods("GET")
+	e.Router.HandleFunc("/hive/jobs/containers/{id}", e.removeContainerJobHandler).Methods("DELETE")
+	e.Router.HandleFunc("/hive/jobs/containers/{id}/history", e.containerJobHistoryHandler).Methods("GET")
+	e.Router.HandleFunc("/hive/jobs/images", e.listImageJobsHandler).Methods("GET")
+	e.Router.HandleFunc("/hive/jobs/images", e.addImageJobHandler).Methods("POST")
+	// image job ids contain the image name which may include slashes
+	e.Router.HandleFunc("/hive/jobs/images/{id:.+}", e.imageJobHandler).Methods("GET")
+	e.Router.HandleFunc("/hive/jobs/images/{id:.+}", e.removeImageJobHandler).Methods("DELETE")
+}
+
+// Writes v as JSON with the status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Writes the error with 404 for missing jobs, the master status for
+// forwarded requests and 500 otherwise
+func jobError(err error, w http.ResponseWriter) {
+	status := http.StatusInternalServerError
+	var masterErr *MasterError
+	switch {
+	case err == ErrJobNotFound:
+		status = http.StatusNotFound
+	case err == ErrJobRemoving:
+		status = http.StatusConflict
+	case err == ErrNotMaster:
+		status = http.StatusServiceUnavailable
+	case errors.As(err, &masterErr):
+		status = masterErr.StatusCode
+	}
+	handlerError(err.Error(), status, w)
+}
+
+func (e *Engine) masterHandler(w http.ResponseWriter, req *http.Request) {
+	name, term, err := getMaster(e.redisPool)
+	if err != nil {
+		handlerError(fmt.Sprintf("Error getting master: %s", err), http.StatusInternalServerError, w)
+		return
+	}
+	if name == "" {
+		handlerError("No master elected", http.StatusServiceUnavailable, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, &MasterInfo{Name: name, Term: term})
+}
+
+func (e *Engine) nodesHandler(w http.ResponseWriter, req *http.Request) {
+	nodes, err := getNodes(e.redisPool, req.URL.Query().Get("zone"))
+	if err != nil {
+		handlerError(fmt.Sprintf("Error getting nodes: %s", err), http.StatusInternalServerError, w)
+		return
+	}
+	cordoned, err := getCordonedNodes(e.redisPool)
+	if err != nil {
+		handlerError(fmt.Sprintf("Error getting cordoned nodes: %s", err), http.StatusInternalServerError, w)
+		return
+	}
+	sort.Sort(nodesByName(nodes))
+	info := []*NodeInfo{}
+	for _, n := range nodes {
+		n.Cordoned = cordoned[getNodeKey(n.Name, n.Zone)]
+		i := &NodeInfo{Node: n}
+		if !n.StartedAt.IsZero() {
+			i.Uptime = time.Since(n.StartedAt).String()
+		}
+		info = append(info, i)
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (e *Engine) cordonHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if err := e.CordonNode(vars["name"], vars["zone"]); err != nil {
+		handlerError(fmt.Sprintf("Error cordoning node: %s", err), http.StatusInternalServerError, w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *Engine) uncordonHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if err := e.UncordonNode(vars["name"], vars["zone"]); err != nil {
+		handlerError(fmt.Sprintf("Error uncordoning node: %s", err), http.StatusInternalServerError, w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *Engine) drainHandler(w http.ResponseWriter, req *http.Request) {
+	// forwarded drains must run on the master
+	if _, master := e.MasterTerm(); !master && isLocalRequest(req) {
+		handlerError(ErrNotMaster.Error(), http.StatusServiceUnavailable, w)
+		return
+	}
+	vars := mux.Vars(req)
+	results, err := e.DrainNode(vars["name"], vars["zone"])
+	if err != nil {
+		handlerError(fmt.Sprintf("Error draining node: %s", err), http.StatusInternalServerError, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (e *Engine) listContainerJobsHandler(w http.ResponseWriter, req *http.Request) {
+	jobs, err := e.Scheduler.ListContainerJobs()
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (e *Engine) addContainerJobHandler(w http.ResponseWriter, req *http.Request) {
+	j := &ContainerJob{}
+	if err := json.NewDecoder(req.Body).Decode(j); err != nil {
+		handlerError(fmt.Sprintf("Error parsing container job: %s", err), http.StatusBadRequest, w)
+		return
+	}
+	if j.Config == nil || j.Config.Name == "" {
+		handlerError("Container job requires a config with a name", http.StatusBadRequest, w)
+		return
+	}
+	if _, err := parseConstraints(j.Config.Constraints); err != nil {
+		handlerError(err.Error(), http.StatusBadRequest, w)
+		return
+	}
+	if j.Zone == "" {
+		j.Zone = e.Zone
+	}
+	id, err := e.Scheduler.AddContainerJob(j)
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &JobResponse{Id: id})
+}
+
+func (e *Engine) containerJobHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	j, err := e.Scheduler.GetContainerJob(id)
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	instances, err := e.Scheduler.ContainerJobInstances(id)
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, &ContainerJobInfo{Job: j, Instances: instances})
+}
+
+func (e *Engine) removeContainerJobHandler(w http.ResponseWriter, req *http.Request) {
+	// forwarded removals must run on the master
+	if _, master := e.MasterTerm(); !master && isLocalRequest(req) {
+		jobError(ErrNotMaster, w)
+		return
+	}
+	results, err := e.RemoveContainerJob(mux.Vars(req)["id"])
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (e *Engine) containerJobHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	history, err := e.Scheduler.ContainerJobHistory(mux.Vars(req)["id"])
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func (e *Engine) listImageJobsHandler(w http.ResponseWriter, req *http.Request) {
+	jobs, err := e.Scheduler.ListImageJobs()
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (e *Engine) addImageJobHandler(w http.ResponseWriter, req *http.Request) {
+	j := &ImageJob{}
+	if err := json.NewDecoder(req.Body).Decode(j); err != nil {
+		handlerError(fmt.Sprintf("Error parsing image job: %s", err), http.StatusBadRequest, w)
+		return
+	}
+	if j.Image == "" {
+		handlerError("Image job requires an image", http.StatusBadRequest, w)
+		return
+	}
+	if j.Zone == "" {
+		j.Zone = e.Zone
+	}
+	id, err := e.Scheduler.AddImageJob(j)
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &JobResponse{Id: id})
+}
+
+func (e *Engine) imageJobHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	j, err := e.Scheduler.GetImageJob(id)
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	status, err := e.Scheduler.ImageJobStatus(id)
+	if err != nil {
+		jobError(err, w)
+		return
+	}
+	writeJSON(w, http.StatusOK, &ImageJobInfo{Id: id, Job: j, Status: status})
+}
+
+func (e *Engine) removeImageJobHandler(w http.ResponseWriter, req *http.Request) {
+	if _, err := e.Scheduler.RemoveImageJob(mux.Vars(req)["id"]); err != nil {
+		jobError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
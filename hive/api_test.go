@@ -0,0 +1,80 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAddContainerJobHandlerInvalidBody(t *testing.T) {
+	e := &Engine{Zone: "default"}
+	for _, body := range []string{"{", `{"Config": {}}`, `{"Config": {"Name": "web", "Constraints": ["ssd"]}}`} {
+		request, _ := http.NewRequest("POST", "/hive/jobs/containers", bytes.NewBufferString(body))
+		response := httptest.NewRecorder()
+		e.addContainerJobHandler(response, request)
+		if response.Code != http.StatusBadRequest {
+			t.Fatalf("Non-expected status code %v for %s: expected %v", response.Code, body, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAddImageJobHandlerRequiresImage(t *testing.T) {
+	e := &Engine{Zone: "default"}
+	request, _ := http.NewRequest("POST", "/hive/jobs/images", bytes.NewBufferString(`{"Zone": "east"}`))
+	response := httptest.NewRecorder()
+	e.addImageJobHandler(response, request)
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Non-expected status code %v: expected %v", response.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRemoveContainerJobForwardedToMaster(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node := newFakeNode(t, s.RedisPool, "node1", "default")
+	addTestJob(t, s, term, node, 1)
+	master := &Engine{Name: "master", Zone: "default", Master: true, term: term, Scheduler: s, redisPool: s.RedisPool, Router: mux.NewRouter()}
+	master.registerApiHandlers()
+	srv := httptest.NewServer(master.Router)
+	defer srv.Close()
+	registerTestNode(t, s.RedisPool, "master", "default", srv.URL)
+
+	e := &Engine{Name: "local", Zone: "default", Scheduler: s, redisPool: s.RedisPool, Router: mux.NewRouter()}
+	e.registerApiHandlers()
+	request, _ := http.NewRequest("DELETE", "/hive/jobs/containers/web", nil)
+	request.Header.Set(HIVE_LOCAL_HEADER, "true")
+	response := httptest.NewRecorder()
+	e.Router.ServeHTTP(response, request)
+	if response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Non-expected status code %v: expected %v", response.Code, http.StatusServiceUnavailable)
+	}
+
+	results, err := e.RemoveContainerJob("web")
+	if err != nil {
+		t.Fatalf("Error removing job: %s", err)
+	}
+	if len(results) != 1 || !results[0].Removed {
+		t.Fatalf("Error: expected instance removed by the master ; received: %+v", results)
+	}
+	_, err = e.RemoveContainerJob("web")
+	if masterErr, ok := err.(*MasterError); !ok || masterErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("Error: expected not found from the master ; received: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/ehazlett/docker-hive/utils"
+)
+
+type (
+	// Typed client for the Docker API of the local daemon
+	EngineClient struct {
+		*utils.DockerClient
+	}
+
+	// Docker create request ; newer daemons take the host config on create
+	// while older ones only use it on start
+	createRequest struct {
+		*ContainerConfig
+		HostConfig *HostConfig `json:",omitempty"`
+	}
+)
+
+// Creates a new typed Docker client
+func NewEngineClient(c *utils.DockerClient) *EngineClient {
+	return &EngineClient{DockerClient: c}
+}
+
+// Returns the containers on the daemon ; stopped containers are included if all is set
+func (c *EngineClient) ListContainers(all bool) ([]APIContainer, error) {
+	containers := []APIContainer{}
+	path := "/containers/json"
+	if all {
+		path += "?all=1"
+	}
+	if err := c.GetJSON(path, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// Returns the container ; id can be a container id, short id or name
+func (c *EngineClient) InspectContainer(id string) (*Container, error) {
+	container := &Container{}
+	if err := c.GetJSON(fmt.Sprintf("/containers/%s/json", url.PathEscape(id)), container); err != nil {
+		if utils.IsDockerStatus(err, http.StatusNotFound) {
+			return nil, ErrContainerNotFound
+		}
+		return nil, err
+	}
+	return container, nil
+}
+
+// Creates a container named by config.Name
+func (c *EngineClient) CreateContainer(config *ContainerConfig, hostConfig *HostConfig) (*CreatedContainer, error) {
+	path := "/containers/create"
+	if config.Name != "" {
+		path = fmt.Sprintf("%s?name=%s", path, url.QueryEscape(config.Name))
+	}
+	created := &CreatedContainer{}
+	if err := c.DoJSON("POST", path, &createRequest{config, hostConfig}, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// Starts the container
+func (c *EngineClient) StartContainer(id string, hostConfig *HostConfig) error {
+	if hostConfig == nil {
+		hostConfig = &HostConfig{}
+	}
+	err := c.DoJSON("POST", fmt.Sprintf("/containers/%s/start", url.PathEscape(id)), hostConfig, nil)
+	if utils.IsDockerStatus(err, http.StatusNotModified) {
+		// already running
+		return nil
+	}
+	if utils.IsDockerStatus(err, http.StatusNotFound) {
+		return ErrContainerNotFound
+	}
+	return err
+}
+
+// Stops and removes the container
+func (c *EngineClient) RemoveContainer(id string) error {
+	path := fmt.Sprintf("/containers/%s", url.PathEscape(id))
+	err := c.DoJSON("POST", fmt.Sprintf("%s/stop?t=%d", path, CONTAINER_STOP_TIMEOUT), nil, nil)
+	if err != nil && !utils.IsDockerStatus(err, http.StatusNotModified) {
+		if utils.IsDockerStatus(err, http.StatusNotFound) {
+			return ErrContainerNotFound
+		}
+		return err
+	}
+	err = c.DoJSON("DELETE", path, nil, nil)
+	if utils.IsDockerStatus(err, http.StatusNotFound) {
+		return ErrContainerNotFound
+	}
+	return err
+}
+
+// Pulls the image and waits for the pull to finish
+func (c *EngineClient) PullImage(image string) error {
+	repo, tag := parseImageName(image)
+	path := fmt.Sprintf("/images/create?fromImage=%s&tag=%s", url.QueryEscape(repo), url.QueryEscape(tag))
+	req, err := http.NewRequest("POST", path, nil)
+	if err != nil {
+		return err
+	}
+	// pulls can take longer than the API timeout
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := utils.CheckDockerResponse(resp); err != nil {
+		return err
+	}
+	// errors are reported in the progress stream
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+	}
+}
+
+// Returns the daemon info
+func (c *EngineClient) Info() (*DockerInfo, error) {
+	info := &DockerInfo{}
+	if err := c.GetJSON("/info", info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Returns the daemon version
+func (c *EngineClient) Version() (string, error) {
+	v := struct {
+		Version string
+	}{}
+	if err := c.GetJSON("/version", &v); err != nil {
+		return "", err
+	}
+	return v.Version, nil
+}
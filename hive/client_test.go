@@ -0,0 +1,91 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/docker-hive/utils"
+)
+
+// Returns a client for a fake Docker daemon served by handler
+func newTestEngineClient(t *testing.T, handler http.Handler) *EngineClient {
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Error listening on %s: %s", sock, err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	endpoint := &utils.DockerEndpoint{Network: "unix", Addr: sock}
+	return NewEngineClient(utils.NewDockerClient(endpoint, time.Second, time.Second))
+}
+
+func TestEngineClientCreateAndStartContainer(t *testing.T) {
+	var created createRequest
+	var started HostConfig
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/create", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("name") != "web" {
+			t.Errorf("Error: expected name web ; received: %s", req.URL.Query().Get("name"))
+		}
+		json.NewDecoder(req.Body).Decode(&created)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id": "abc123"}`))
+	})
+	mux.HandleFunc("/containers/abc123/start", func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&started)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	c := newTestEngineClient(t, mux)
+
+	config := &ContainerConfig{Image: "busybox", Name: "web"}
+	hostConfig := &HostConfig{Links: []string{"db:db"}}
+	container, err := c.CreateContainer(config, hostConfig)
+	if err != nil {
+		t.Fatalf("Error creating container: %s", err)
+	}
+	if container.Id != "abc123" {
+		t.Fatalf("Error: expected id abc123 ; received: %s", container.Id)
+	}
+	if created.ContainerConfig == nil || created.Image != "busybox" {
+		t.Fatalf("Error: expected image busybox in create request")
+	}
+	if created.HostConfig == nil || len(created.HostConfig.Links) != 1 {
+		t.Fatalf("Error: expected host config in create request")
+	}
+	if err := c.StartContainer(container.Id, hostConfig); err != nil {
+		t.Fatalf("Error starting container: %s", err)
+	}
+	if len(started.Links) != 1 {
+		t.Fatalf("Error: expected host config on start ; received: %v", started)
+	}
+}
+
+func TestEngineClientInspectContainerNotFound(t *testing.T) {
+	c := newTestEngineClient(t, http.NotFoundHandler())
+	if _, err := c.InspectContainer("foo"); err != ErrContainerNotFound {
+		t.Fatalf("Error: expected %s ; received: %v", ErrContainerNotFound, err)
+	}
+}
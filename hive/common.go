@@ -20,18 +20,56 @@ import (
 )
 
 const (
+	CONTAINER_COUNT_KEY       = "counts:containers"
+	CONTAINER_INDEX_INTERVAL  = 5
+	CONTAINER_INDEX_KEY       = "containers"
 	CONTAINER_JOB_KEY         = "jobs:containers"
+	CONTAINER_STOP_TIMEOUT    = 10
+	CORDON_KEY                = "cordoned"
+	CPU_SHARES_PER_CPU        = 1024
+	DOCKER_API_VERSION        = "v1.10"
+	EXEC_INDEX_KEY            = "execs"
+	EXEC_INDEX_TTL            = 3600
+	HIVE_LOCAL_HEADER         = "X-Hive-Local"
+	HIVE_WARNING_HEADER       = "X-Hive-Warning"
 	IMAGE_JOB_KEY             = "jobs:images"
+	IMAGE_JOB_PULLS_KEY       = "jobs:imagepulls"
+	IMAGE_JOB_STATUS_KEY      = "jobs:imagestatus"
+	IMAGE_PULL_TIMEOUT        = 600
 	JOB_KEY                   = "jobs"
-	JOB_NODE_KEY              = "nodes:jobs"
+	JOB_HISTORY_KEY           = "jobs:history"
+	JOB_HISTORY_LIMIT         = 1000
+	JOB_HISTORY_TTL           = 86400
+	JOB_INSTANCES_KEY         = "jobs:instances"
 	JOB_INTERVAL              = 10
+	LABELS_KEY                = "labels"
+	LOST_CONTAINERS_KEY       = "lost"
+	MANAGED_CONTAINERS_KEY    = "managed:containers"
 	MASTER_HEARTBEAT_INTERVAL = 2
 	MASTER_KEY                = "master"
+	MASTER_TERM_KEY           = "master:term"
 	NODE_HEARTBEAT_INTERVAL   = 1
+	NODE_DEAD_GRACE           = 30
 	NODE_KEY                  = "nodes"
+	NODE_REAPER_INTERVAL      = 30
+	NODE_TTL                  = 5
+	REMOVED_JOBS_KEY          = "jobs:removed"
+	RESOURCES_KEY             = "resources"
+	SHUTDOWN_TIMEOUT          = 10
+	ZONE_KEY                  = "zones"
 )
 
 // Returns node key
 func getNodeKey(node string, zone string) string {
 	return fmt.Sprintf("%s:%s:%s", NODE_KEY, zone, node)
 }
+
+// Appends value to list if not already present
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
@@ -16,8 +16,18 @@
 package hive
 
 import (
+	"encoding/json"
+	"fmt"
 	_ "log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func TestGetNodeKey(t *testing.T) {
@@ -27,3 +37,164 @@ func TestGetNodeKey(t *testing.T) {
 		t.Fatalf("Error: expected %s ; received: %s", testKey, key)
 	}
 }
+
+const (
+	testRedisAddr = "127.0.0.1:6379"
+	testRedisDB   = 15
+)
+
+// Fake hive node serving the Docker container API from memory
+type fakeNode struct {
+	*httptest.Server
+	Name string
+	// status returned for inspect and delete requests when set
+	InspectStatus int
+	RemoveStatus  int
+	lock          sync.Mutex
+	containers    map[string]*Container
+	removed       []string
+	count         int
+}
+
+// Returns an empty test Redis database ; the test is skipped if Redis is
+// not available
+func newTestPool(t *testing.T) *redis.Pool {
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial("tcp", testRedisAddr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := c.Do("SELECT", testRedisDB); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		},
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("FLUSHDB"); err != nil {
+		pool.Close()
+		t.Skipf("Redis not available at %s: %s", testRedisAddr, err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+// Starts a fake node and registers it in the zone
+func newFakeNode(t *testing.T, pool *redis.Pool, name string, zone string) *fakeNode {
+	f := &fakeNode{
+		Name:       name,
+		containers: make(map[string]*Container),
+	}
+	f.Server = httptest.NewServer(f)
+	t.Cleanup(f.Close)
+	registerTestNode(t, pool, name, zone, f.URL)
+	return f
+}
+
+// Publishes a node record with a current heartbeat
+func registerTestNode(t *testing.T, pool *redis.Pool, name string, zone string, addr string) {
+	data, _ := json.Marshal(&Node{Address: addr, LastHeartbeat: time.Now()})
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("SET", getNodeKey(name, zone), data)
+	indexNode(conn, name, zone, time.Now())
+	if _, err := conn.Do(""); err != nil {
+		t.Fatalf("Error registering node %s: %s", name, err)
+	}
+}
+
+// Adds a container to the fake node
+func (f *fakeNode) AddContainer(id string, config *ContainerConfig, running bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := &Container{Id: id, Name: "/" + id, Config: *config}
+	c.State.Running = running
+	f.containers[id] = c
+}
+
+// Returns the ids of the containers on the fake node
+func (f *fakeNode) Containers() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ids := []string{}
+	for id := range f.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Returns the ids of the containers removed from the fake node
+func (f *fakeNode) Removed() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.removed...)
+}
+
+func (f *fakeNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// strip the api version
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")[1:]
+	if len(parts) < 2 || parts[0] != "containers" {
+		http.NotFound(w, req)
+		return
+	}
+	switch {
+	case parts[1] == "create" && req.Method == "POST":
+		config := &ContainerConfig{}
+		json.NewDecoder(req.Body).Decode(config)
+		f.count++
+		id := fmt.Sprintf("%s-%d", f.Name, f.count)
+		c := &Container{Id: id, Name: "/" + req.URL.Query().Get("name"), Config: *config}
+		f.containers[id] = c
+		writeJSON(w, http.StatusCreated, map[string]string{"Id": id})
+	case parts[1] == "json" && req.Method == "GET":
+		containers := []APIContainer{}
+		for _, c := range f.containers {
+			if c.State.Running {
+				containers = append(containers, APIContainer{Id: c.Id, Image: c.Config.Image, Names: []string{c.Name}, Status: "Up"})
+			}
+		}
+		writeJSON(w, http.StatusOK, containers)
+	case len(parts) == 2 && req.Method == "DELETE":
+		if f.RemoveStatus != 0 {
+			w.WriteHeader(f.RemoveStatus)
+			return
+		}
+		if _, ok := f.containers[parts[1]]; !ok {
+			http.NotFound(w, req)
+			return
+		}
+		delete(f.containers, parts[1])
+		f.removed = append(f.removed, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3:
+		c, ok := f.containers[parts[1]]
+		if parts[2] == "json" && f.InspectStatus != 0 {
+			w.WriteHeader(f.InspectStatus)
+			return
+		}
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		switch parts[2] {
+		case "json":
+			writeJSON(w, http.StatusOK, c)
+		case "start":
+			c.State.Running = true
+			w.WriteHeader(http.StatusNoContent)
+		case "stop":
+			c.State.Running = false
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, req)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
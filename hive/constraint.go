@@ -0,0 +1,165 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type (
+	Constraint struct {
+		Key      string
+		Operator string
+		Value    string
+		regex    *regexp.Regexp
+	}
+)
+
+// Parses a constraint expression (i.e. storage==ssd, gpu!=true or
+// region==/eu-.*/)
+func parseConstraint(expr string) (*Constraint, error) {
+	for _, op := range []string{"==", "!="} {
+		parts := strings.SplitN(expr, op, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		c := &Constraint{
+			Key:      strings.TrimSpace(parts[0]),
+			Operator: op,
+			Value:    strings.TrimSpace(parts[1]),
+		}
+		if c.Key == "" {
+			return nil, fmt.Errorf("Invalid constraint %q: missing key", expr)
+		}
+		if len(c.Value) > 1 && strings.HasPrefix(c.Value, "/") && strings.HasSuffix(c.Value, "/") {
+			re, err := regexp.Compile(fmt.Sprintf("^%s$", c.Value[1:len(c.Value)-1]))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid constraint %q: %s", expr, err)
+			}
+			c.regex = re
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("Invalid constraint %q: expected key==value or key!=value", expr)
+}
+
+// Parses a list of constraint expressions
+func parseConstraints(exprs []string) ([]*Constraint, error) {
+	constraints := []*Constraint{}
+	for _, expr := range exprs {
+		c, err := parseConstraint(expr)
+		if err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, c)
+	}
+	return constraints, nil
+}
+
+// Returns true if the labels satisfy the constraint ; a missing label
+// only satisfies != constraints
+func (c *Constraint) Match(labels map[string]string) bool {
+	v, ok := labels[c.Key]
+	matched := false
+	if ok {
+		if c.regex != nil {
+			matched = c.regex.MatchString(v)
+		} else {
+			matched = v == c.Value
+		}
+	}
+	if c.Operator == "!=" {
+		return !matched
+	}
+	return matched
+}
+
+// Returns true if the labels satisfy all constraints
+func matchConstraints(constraints []*Constraint, labels map[string]string) bool {
+	for _, c := range constraints {
+		if !c.Match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns node labels key
+func getLabelsKey(node string, zone string) string {
+	return fmt.Sprintf("%s:%s:%s", LABELS_KEY, zone, node)
+}
+
+// Returns the published labels for the node including the implicit
+// node and zone labels
+func getNodeLabels(pool *redis.Pool, n *Node) (map[string]string, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	labels, err := redis.StringMap(conn.Do("HGETALL", getLabelsKey(n.Name, n.Zone)))
+	if err != nil {
+		return nil, err
+	}
+	labels["node"] = n.Name
+	labels["zone"] = n.Zone
+	return labels, nil
+}
+
+// Returns the schedulable nodes in the container zone that satisfy the
+// container constraints
+func candidateNodes(pool *redis.Pool, config *ContainerConfig) ([]*Node, error) {
+	constraints, err := parseConstraints(config.Constraints)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := getNodes(pool, config.Zone)
+	if err != nil {
+		return nil, err
+	}
+	cordoned, err := getCordonedNodes(pool)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []*Node{}
+	for _, n := range nodes {
+		if cordoned[getNodeKey(n.Name, n.Zone)] {
+			continue
+		}
+		if len(constraints) == 0 {
+			candidates = append(candidates, n)
+			continue
+		}
+		labels, err := getNodeLabels(pool, n)
+		if err != nil {
+			continue
+		}
+		if matchConstraints(constraints, labels) {
+			candidates = append(candidates, n)
+		}
+	}
+	return candidates, nil
+}
+
+// Returns the names of the nodes
+func nodeNames(nodes []*Node) []string {
+	names := []string{}
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
@@ -0,0 +1,72 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"testing"
+)
+
+func TestParseConstraintInvalid(t *testing.T) {
+	for _, expr := range []string{"storage", "==ssd", "region==/eu-(/"} {
+		if _, err := parseConstraint(expr); err == nil {
+			t.Fatalf("Error: expected error for constraint %s", expr)
+		}
+	}
+}
+
+func TestConstraintMatch(t *testing.T) {
+	labels := map[string]string{
+		"storage": "ssd",
+		"gpu":     "false",
+		"region":  "eu-west",
+	}
+	tests := map[string]bool{
+		"storage==ssd":     true,
+		"storage!=ssd":     false,
+		"gpu!=true":        true,
+		"region==/eu-.*/":  true,
+		"region!=/us-.*/":  true,
+		"region==/eu/":     false,
+		"missing==foo":     false,
+		"missing!=foo":     true,
+		" storage == ssd ": true,
+	}
+	for expr, expected := range tests {
+		c, err := parseConstraint(expr)
+		if err != nil {
+			t.Fatalf("Error parsing constraint %s: %s", expr, err)
+		}
+		if c.Match(labels) != expected {
+			t.Fatalf("Error: expected %s to be %v", expr, expected)
+		}
+	}
+}
+
+func TestCandidateNodesSkipsCordonedNodes(t *testing.T) {
+	pool := newTestPool(t)
+	registerTestNode(t, pool, "node1", "default", "http://node1:4500")
+	registerTestNode(t, pool, "node2", "default", "http://node2:4500")
+	if err := cordonNode(pool, getNodeKey("node2", "default")); err != nil {
+		t.Fatalf("Error cordoning node: %s", err)
+	}
+	nodes, err := candidateNodes(pool, &ContainerConfig{Zone: "default"})
+	if err != nil {
+		t.Fatalf("Error getting candidate nodes: %s", err)
+	}
+	if names := nodeNames(nodes); len(names) != 1 || names[0] != "node1" {
+		t.Fatalf("Error: expected [node1] ; received: %v", names)
+	}
+}
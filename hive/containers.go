@@ -0,0 +1,219 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/ehazlett/docker-hive/utils"
+	"github.com/garyburd/redigo/redis"
+)
+
+type (
+	CreatedContainer struct {
+		Id       string
+		Node     string
+		Zone     string
+		Warnings []string
+	}
+
+	ContainerCreateResponse struct {
+		Id         string
+		Warnings   []string
+		Containers []*CreatedContainer
+	}
+
+	// Creates a container with the name on the node
+	createFunc func(n *Node, name string) (*CreatedContainer, error)
+)
+
+// Returns the name for an instance of a container ; instances are
+// numbered when more than one is requested
+func instanceName(name string, instance int, numInstances int64) string {
+	if name == "" || numInstances <= 1 {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", name, instance)
+}
+
+// Creates a container on the node
+func createContainer(n *Node, apiVersion string, config *ContainerConfig, name string) (*CreatedContainer, error) {
+	buf := bytes.NewBufferString("")
+	if err := json.NewEncoder(buf).Encode(config); err != nil {
+		return nil, err
+	}
+	return createContainerFromBody(n, apiVersion, buf, name)
+}
+
+// Creates a container on the node from the create request body as sent
+// by the client so fields hive does not know about are kept
+func createContainerFromBody(n *Node, apiVersion string, body io.Reader, name string) (*CreatedContainer, error) {
+	path := fmt.Sprintf("/%s/containers/create", apiVersion)
+	if name != "" {
+		path = fmt.Sprintf("%s?name=%s", path, url.QueryEscape(name))
+	}
+	resp, err := nodeRequest(n, "POST", path, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := utils.CheckDockerResponse(resp); err != nil {
+		return nil, fmt.Errorf("node %s: %w", n.Name, err)
+	}
+	c := &CreatedContainer{
+		Node: n.Name,
+		Zone: n.Zone,
+	}
+	if err := json.NewDecoder(resp.Body).Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Creates the requested number of instances of the container on nodes
+// selected by the run policy ; body is the create request from the client
+// and config is only used for scheduling
+func (e *Engine) runContainers(apiVersion string, body []byte, config *ContainerConfig, name string) ([]*CreatedContainer, error) {
+	if config.Zone == "" {
+		config.Zone = e.Zone
+	}
+	create := func(n *Node, name string) (*CreatedContainer, error) {
+		return createContainerFromBody(n, apiVersion, bytes.NewReader(body), name)
+	}
+	return placeContainers(e.redisPool, e.RunPolicy, config, name, create, nil)
+}
+
+// Creates the requested number of instances of the container in the
+// config zone on nodes selected by the policy ; check (if set) is called
+// before each create and stops placement with the containers created so far
+func placeContainers(pool *redis.Pool, policy RunPolicy, config *ContainerConfig, name string, create createFunc, check func() error) ([]*CreatedContainer, error) {
+	if config.Name == "" {
+		config.Name = name
+	}
+	if config.NumberOfInstances <= 0 {
+		config.NumberOfInstances = 1
+	}
+	selected, err := policy.GetNodes(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("Run policy returned no nodes")
+	}
+	containers := []*CreatedContainer{}
+	var createErr error
+	for i, nodeName := range selected {
+		nodeKey := getNodeKey(nodeName, config.Zone)
+		n, err := getNode(pool, nodeKey)
+		if err != nil {
+			log.Printf("Error getting node %s: %s", nodeName, err)
+			continue
+		}
+		if check != nil {
+			if err := check(); err != nil {
+				return containers, err
+			}
+		}
+		cName := instanceName(name, i+1, config.NumberOfInstances)
+		c, err := create(n, cName)
+		if err != nil {
+			log.Printf("Error creating container on node %s: %s", n.Name, err)
+			createErr = err
+			continue
+		}
+		indexContainer(pool, c.Id, nodeKey)
+		addManagedContainer(pool, c.Id, nodeKey)
+		if cName != "" {
+			indexContainer(pool, cName, nodeKey)
+		}
+		log.Printf("Created container %s on node %s", c.Id, n.Name)
+		containers = append(containers, c)
+	}
+	if len(containers) == 0 {
+		if createErr != nil {
+			// keep the node error so its status is returned to the client
+			return nil, fmt.Errorf("Unable to create container on any node: %w", createErr)
+		}
+		return nil, errors.New("Unable to create container on any node")
+	}
+	return containers, nil
+}
+
+// Returns the container from the node
+func inspectContainer(n *Node, apiVersion string, id string) (*Container, error) {
+	resp, err := nodeRequest(n, "GET", fmt.Sprintf("/%s/containers/%s/json", apiVersion, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrContainerNotFound
+	default:
+		return nil, fmt.Errorf("node %s returned status %d", n.Name, resp.StatusCode)
+	}
+	container := &Container{}
+	if err := json.NewDecoder(resp.Body).Decode(container); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// Starts the container on the node
+func startContainer(n *Node, apiVersion string, id string, hostConfig *HostConfig) error {
+	if hostConfig == nil {
+		hostConfig = &HostConfig{}
+	}
+	buf := bytes.NewBufferString("")
+	if err := json.NewEncoder(buf).Encode(hostConfig); err != nil {
+		return err
+	}
+	return nodeAction(n, "POST", fmt.Sprintf("/%s/containers/%s/start", apiVersion, id), buf)
+}
+
+// Stops and removes the container from the node
+func removeContainer(n *Node, apiVersion string, id string) error {
+	if err := nodeAction(n, "POST", fmt.Sprintf("/%s/containers/%s/stop?t=%d", apiVersion, id, CONTAINER_STOP_TIMEOUT), nil); err != nil {
+		log.Printf("Error stopping container %s on node %s: %s", id, n.Name, err)
+	}
+	return nodeAction(n, "DELETE", fmt.Sprintf("/%s/containers/%s", apiVersion, id), nil)
+}
+
+// Performs a request against the node that returns no content
+func nodeAction(n *Node, method string, path string, body io.Reader) error {
+	resp, err := nodeRequest(n, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if resp.StatusCode == http.StatusNotModified {
+			return nil
+		}
+		msg := new(bytes.Buffer)
+		msg.ReadFrom(resp.Body)
+		return fmt.Errorf("node %s returned status %d: %s", n.Name, resp.StatusCode, msg.String())
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"testing"
+)
+
+func TestInstanceName(t *testing.T) {
+	if name := instanceName("web", 1, 1); name != "web" {
+		t.Fatalf("Error: expected web ; received: %s", name)
+	}
+	if name := instanceName("web", 2, 3); name != "web-2" {
+		t.Fatalf("Error: expected web-2 ; received: %s", name)
+	}
+	if name := instanceName("", 2, 3); name != "" {
+		t.Fatalf("Error: expected empty name ; received: %s", name)
+	}
+}
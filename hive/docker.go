@@ -24,7 +24,15 @@
 package hive
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -54,6 +62,7 @@ type (
 
 	Container struct {
 		Id              string
+		Name            string
 		Args            []string
 		Config          ContainerConfig
 		Created         time.Time
@@ -96,6 +105,7 @@ type (
 		WorkingDir        string
 		Zone              string
 		NumberOfInstances int64
+		Constraints       []string
 	}
 
 	KeyValuePair struct {
@@ -127,20 +137,294 @@ type (
 		Subrouter *mux.Router
 		engine    *Engine
 	}
+
+	// Records the status and body of a response while writing it
+	capturedResponse struct {
+		http.ResponseWriter
+		status int
+		body   bytes.Buffer
+	}
+
+	containersByCreated []APIContainer
+	imagesByCreated     []*ClusterImage
 )
 
+func (c *capturedResponse) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+// Returns the response status ; 200 if no status was written
+func (c *capturedResponse) Status() int {
+	if c.status == 0 {
+		return http.StatusOK
+	}
+	return c.status
+}
+
+func (c *capturedResponse) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(p)
+	return c.ResponseWriter.Write(p)
+}
+
+func (c containersByCreated) Len() int           { return len(c) }
+func (c containersByCreated) Less(i, j int) bool { return c[i].Created < c[j].Created }
+func (c containersByCreated) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func (c imagesByCreated) Len() int           { return len(c) }
+func (c imagesByCreated) Less(i, j int) bool { return c[i].Created < c[j].Created }
+func (c imagesByCreated) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
 // Returns a new mux subrouter that acts as an adapter to support the Docker API
 func NewDockerSubrouter(engine *Engine) *DockerRouter {
-	s := engine.Router.PathPrefix("/{apiVersion:v1.*}").Subrouter()
+	s := engine.Router.PathPrefix("/{apiVersion:v1\\.[0-9]+}").Subrouter()
 	rtr := &DockerRouter{
 		Subrouter: s,
 		engine:    engine,
 	}
-	s.HandleFunc("/{.*}", rtr.dockerHandler).Methods("GET", "PUT", "POST", "DELETE")
+	s.HandleFunc("/containers/json", rtr.containersHandler).Methods("GET")
+	s.HandleFunc("/images/json", rtr.imagesHandler).Methods("GET")
+	s.HandleFunc("/containers/create", rtr.containerCreateHandler).Methods("POST")
+	s.HandleFunc("/containers/{id}/{action}", rtr.containerHandler).Methods("GET", "POST")
+	s.HandleFunc("/containers/{id}", rtr.containerHandler).Methods("DELETE")
+	s.HandleFunc("/exec/{id}/{action}", rtr.execHandler).Methods("GET", "POST")
+	s.PathPrefix("/").HandlerFunc(rtr.dockerHandler).Methods("GET", "PUT", "POST", "DELETE")
 	return rtr
 }
 
 // Docker: generic handler
 func (r *DockerRouter) dockerHandler(w http.ResponseWriter, req *http.Request) {
-	utils.ProxyLocalDockerRequest(w, req, r.engine.DockerPath)
+	utils.ProxyLocalDockerRequest(w, req, r.engine.Docker.DockerClient)
+}
+
+// Docker: lists containers across all nodes (optionally filtered by zone)
+func (r *DockerRouter) containersHandler(w http.ResponseWriter, req *http.Request) {
+	if isLocalRequest(req) {
+		r.dockerHandler(w, req)
+		return
+	}
+	req.ParseForm()
+	zone := req.Form.Get("zone")
+	req.Form.Del("zone")
+	nodes, err := getNodes(r.engine.redisPool, zone)
+	if err != nil {
+		handlerError(fmt.Sprintf("Error getting nodes: %s", err), http.StatusInternalServerError, w)
+		return
+	}
+	path := fmt.Sprintf("/%s/containers/json?%s", mux.Vars(req)["apiVersion"], req.Form.Encode())
+	containers := []APIContainer{}
+	failed := []string{}
+	var lock sync.Mutex
+	forEachNode(nodes, func(n *Node) {
+		nodeContainers := []APIContainer{}
+		if err := getNodeJSON(n, path, &nodeContainers); err != nil {
+			log.Printf("Error getting containers from node %s: %s", n.Name, err)
+			lock.Lock()
+			failed = append(failed, n.Name)
+			lock.Unlock()
+			return
+		}
+		for i := range nodeContainers {
+			nodeContainers[i].Node = n.Name
+		}
+		lock.Lock()
+		containers = append(containers, nodeContainers...)
+		lock.Unlock()
+	})
+	if !aggregateWarning(w, nodes, failed) {
+		return
+	}
+	// newest first to match Docker
+	sort.Sort(sort.Reverse(containersByCreated(containers)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(containers)
+}
+
+// Reports nodes that failed during aggregation ; a warning header lists the
+// failed nodes and false is returned after an error if every node failed
+func aggregateWarning(w http.ResponseWriter, nodes []*Node, failed []string) bool {
+	if len(failed) == 0 {
+		return true
+	}
+	sort.Strings(failed)
+	msg := fmt.Sprintf("Unable to reach node(s): %s", strings.Join(failed, ", "))
+	if len(failed) == len(nodes) {
+		handlerError(msg, http.StatusBadGateway, w)
+		return false
+	}
+	w.Header().Set(HIVE_WARNING_HEADER, msg)
+	return true
+}
+
+// Merges images from a node into the cluster image index keyed by image id
+func mergeImages(index map[string]*ClusterImage, n *Node, images []Image) {
+	for _, img := range images {
+		ci, ok := index[img.Id]
+		if !ok {
+			ci = &ClusterImage{Image: img}
+			index[img.Id] = ci
+		}
+		ci.Nodes = appendUnique(ci.Nodes, n.Name)
+		ci.Zones = appendUnique(ci.Zones, n.Zone)
+		for _, t := range img.RepoTags {
+			ci.RepoTags = appendUnique(ci.RepoTags, t)
+		}
+	}
+}
+
+// Docker: lists images across all nodes with the nodes each is present on
+func (r *DockerRouter) imagesHandler(w http.ResponseWriter, req *http.Request) {
+	if isLocalRequest(req) {
+		r.dockerHandler(w, req)
+		return
+	}
+	req.ParseForm()
+	zone := req.Form.Get("zone")
+	req.Form.Del("zone")
+	nodes, err := getNodes(r.engine.redisPool, zone)
+	if err != nil {
+		handlerError(fmt.Sprintf("Error getting nodes: %s", err), http.StatusInternalServerError, w)
+		return
+	}
+	path := fmt.Sprintf("/%s/images/json?%s", mux.Vars(req)["apiVersion"], req.Form.Encode())
+	index := make(map[string]*ClusterImage)
+	failed := []string{}
+	var lock sync.Mutex
+	forEachNode(nodes, func(n *Node) {
+		nodeImages := []Image{}
+		if err := getNodeJSON(n, path, &nodeImages); err != nil {
+			log.Printf("Error getting images from node %s: %s", n.Name, err)
+			lock.Lock()
+			failed = append(failed, n.Name)
+			lock.Unlock()
+			return
+		}
+		lock.Lock()
+		mergeImages(index, n, nodeImages)
+		lock.Unlock()
+	})
+	if !aggregateWarning(w, nodes, failed) {
+		return
+	}
+	images := []*ClusterImage{}
+	for _, ci := range index {
+		sort.Strings(ci.Nodes)
+		sort.Strings(ci.Zones)
+		images = append(images, ci)
+	}
+	sort.Sort(sort.Reverse(imagesByCreated(images)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
+
+// Returns the status for a Docker error ; the node status is used for
+// errors returned by a node
+func dockerErrorStatus(err error) int {
+	var dockerErr *utils.DockerError
+	switch {
+	case err == ErrContainerNotFound:
+		return http.StatusNotFound
+	case errors.As(err, &dockerErr):
+		return dockerErr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// Docker: creates containers on nodes selected by the run policy
+func (r *DockerRouter) containerCreateHandler(w http.ResponseWriter, req *http.Request) {
+	if isLocalRequest(req) {
+		r.dockerHandler(w, req)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		handlerError(fmt.Sprintf("Error reading container config: %s", err), http.StatusBadRequest, w)
+		return
+	}
+	config := &ContainerConfig{}
+	if err := json.Unmarshal(body, config); err != nil {
+		handlerError(fmt.Sprintf("Error parsing container config: %s", err), http.StatusBadRequest, w)
+		return
+	}
+	if _, err := parseConstraints(config.Constraints); err != nil {
+		handlerError(err.Error(), http.StatusBadRequest, w)
+		return
+	}
+	containers, err := r.engine.runContainers(mux.Vars(req)["apiVersion"], body, config, req.URL.Query().Get("name"))
+	if err != nil {
+		handlerError(fmt.Sprintf("Error creating container: %s", err), dockerErrorStatus(err), w)
+		return
+	}
+	resp := &ContainerCreateResponse{
+		Id:         containers[0].Id,
+		Warnings:   containers[0].Warnings,
+		Containers: containers,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Docker: proxies container specific requests to the node running the container
+func (r *DockerRouter) containerHandler(w http.ResponseWriter, req *http.Request) {
+	if isLocalRequest(req) {
+		r.dockerHandler(w, req)
+		return
+	}
+	vars := mux.Vars(req)
+	id := vars["id"]
+	n, err := findContainerNode(r.engine.redisPool, id, vars["apiVersion"])
+	if err != nil {
+		handlerError(fmt.Sprintf("%s: %s", err, id), dockerErrorStatus(err), w)
+		return
+	}
+	// exec instances are only known to the node that created them and
+	// removed containers are unindexed once the node has removed them
+	if vars["action"] != "exec" && req.Method != "DELETE" {
+		r.proxyToNode(w, req, n)
+		return
+	}
+	resp := &capturedResponse{ResponseWriter: w}
+	r.proxyToNode(resp, req, n)
+	switch {
+	case req.Method == "DELETE":
+		if resp.Status() >= 200 && resp.Status() < 300 {
+			unindexContainer(r.engine.redisPool, id)
+		}
+	case resp.Status() == http.StatusCreated:
+		created := struct {
+			Id string
+		}{}
+		if err := json.Unmarshal(resp.body.Bytes(), &created); err == nil && created.Id != "" {
+			indexExec(r.engine.redisPool, created.Id, getNodeKey(n.Name, n.Zone))
+		}
+	}
+}
+
+// Docker: proxies exec requests to the node that created the exec instance
+func (r *DockerRouter) execHandler(w http.ResponseWriter, req *http.Request) {
+	if isLocalRequest(req) {
+		r.dockerHandler(w, req)
+		return
+	}
+	n, err := findExecNode(r.engine.redisPool, mux.Vars(req)["id"])
+	if err != nil {
+		// not created through the hive ; let the local daemon answer
+		r.dockerHandler(w, req)
+		return
+	}
+	r.proxyToNode(w, req, n)
+}
+
+// Proxies the request to the local Docker daemon of the node
+func (r *DockerRouter) proxyToNode(w http.ResponseWriter, req *http.Request, n *Node) {
+	if n.Name == r.engine.Name && n.Zone == r.engine.Zone {
+		r.dockerHandler(w, req)
+		return
+	}
+	req.Header.Set(HIVE_LOCAL_HEADER, "true")
+	utils.ProxyRemoteRequest(w, req, n.Address)
 }
@@ -0,0 +1,282 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMergeImages(t *testing.T) {
+	index := make(map[string]*ClusterImage)
+	img := Image{Id: "abc", RepoTags: []string{"busybox:latest"}}
+	mergeImages(index, &Node{Name: "node1", Zone: "east"}, []Image{img})
+	mergeImages(index, &Node{Name: "node2", Zone: "west"}, []Image{img})
+	mergeImages(index, &Node{Name: "node3", Zone: "west"}, []Image{img})
+	if len(index) != 1 {
+		t.Fatalf("Error: expected 1 image ; received: %d", len(index))
+	}
+	ci := index["abc"]
+	if len(ci.Nodes) != 3 {
+		t.Fatalf("Error: expected 3 nodes ; received: %v", ci.Nodes)
+	}
+	if len(ci.Zones) != 2 {
+		t.Fatalf("Error: expected 2 zones ; received: %v", ci.Zones)
+	}
+	if len(ci.RepoTags) != 1 {
+		t.Fatalf("Error: expected 1 tag ; received: %v", ci.RepoTags)
+	}
+}
+
+func TestExecStartRoutedToRemoteNode(t *testing.T) {
+	pool := newTestPool(t)
+	m := http.NewServeMux()
+	m.HandleFunc("/v1.10/containers/web/exec", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]string{"Id": "exec1"})
+	})
+	m.HandleFunc("/v1.10/exec/exec1/start", func(w http.ResponseWriter, req *http.Request) {
+		if !isLocalRequest(req) {
+			t.Errorf("Error: expected exec start to be local to the remote node")
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Error hijacking connection: %s", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\nhello")
+		buf.Flush()
+	})
+	remote := httptest.NewServer(m)
+	defer remote.Close()
+	registerTestNode(t, pool, "remote", "default", remote.URL)
+	indexContainer(pool, "web", getNodeKey("remote", "default"))
+
+	e := &Engine{Name: "local", Zone: "default", redisPool: pool, Router: mux.NewRouter()}
+	NewDockerSubrouter(e)
+	srv := httptest.NewServer(e.Router)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/v1.10/containers/web/exec", "application/json", strings.NewReader(`{"Cmd": ["sh"]}`))
+	if err != nil {
+		t.Fatalf("Error creating exec: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Non-expected status code %v: expected %v", resp.StatusCode, http.StatusCreated)
+	}
+	resp, err = http.Post(srv.URL+"/v1.10/exec/exec1/start", "application/json", strings.NewReader(`{"Detach": false}`))
+	if err != nil {
+		t.Fatalf("Error starting exec: %s", err)
+	}
+	defer resp.Body.Close()
+	out, _ := ioutil.ReadAll(resp.Body)
+	if string(out) != "hello" {
+		t.Fatalf("Error: expected hello from remote node ; received: %q", out)
+	}
+}
+
+func TestContainersHandlerReportsFailedNodes(t *testing.T) {
+	pool := newTestPool(t)
+	node := newFakeNode(t, pool, "node1", "default")
+	node.AddContainer("node1-web", &ContainerConfig{Name: "web", Image: "busybox"}, true)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	registerTestNode(t, pool, "node2", "default", down.URL)
+
+	e := &Engine{Name: "local", Zone: "default", redisPool: pool, Router: mux.NewRouter()}
+	NewDockerSubrouter(e)
+	srv := httptest.NewServer(e.Router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/v1.10/containers/json")
+	if err != nil {
+		t.Fatalf("Error listing containers: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Non-expected status code %v: expected %v", resp.StatusCode, http.StatusOK)
+	}
+	if warning := resp.Header.Get(HIVE_WARNING_HEADER); !strings.Contains(warning, "node2") {
+		t.Fatalf("Error: expected warning for node2 ; received: %q", warning)
+	}
+
+	node.Close()
+	resp, err = http.Get(srv.URL + "/v1.10/containers/json")
+	if err != nil {
+		t.Fatalf("Error listing containers: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Non-expected status code %v: expected %v", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestDockerHandlerErrorsUseDockerFormat(t *testing.T) {
+	pool := newTestPool(t)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "No such image: foo"}`))
+	}))
+	defer node.Close()
+	registerTestNode(t, pool, "node1", "default", node.URL)
+
+	e := &Engine{Name: "local", Zone: "default", redisPool: pool, Router: mux.NewRouter(), RunPolicy: &RandomPolicy{RedisPool: pool}}
+	NewDockerSubrouter(e)
+	srv := httptest.NewServer(e.Router)
+	defer srv.Close()
+
+	tests := []struct {
+		method  string
+		path    string
+		body    string
+		status  int
+		message string
+	}{
+		{"GET", "/v1.10/containers/missing/json", "", http.StatusNotFound, "No such container"},
+		{"POST", "/v1.10/containers/create", "{", http.StatusBadRequest, "Error parsing container config"},
+		{"POST", "/v1.10/containers/create", `{"Image": "foo"}`, http.StatusNotFound, "No such image: foo"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error requesting %s: %s", test.path, err)
+		}
+		body := map[string]string{}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("Non-expected status code %v for %s: expected %v", resp.StatusCode, test.path, test.status)
+		}
+		if err != nil || !strings.Contains(body["message"], test.message) {
+			t.Fatalf("Error: expected message %q for %s ; received: %v %v", test.message, test.path, body, err)
+		}
+	}
+}
+
+func TestContainerDeleteUnindexesOnSuccess(t *testing.T) {
+	pool := newTestPool(t)
+	node := newFakeNode(t, pool, "node1", "default")
+	node.AddContainer("web", &ContainerConfig{Name: "web"}, false)
+	nodeKey := getNodeKey("node1", "default")
+	indexContainer(pool, "web", nodeKey)
+
+	e := &Engine{Name: "local", Zone: "default", redisPool: pool, Router: mux.NewRouter()}
+	NewDockerSubrouter(e)
+	srv := httptest.NewServer(e.Router)
+	defer srv.Close()
+	remove := func() int {
+		req, _ := http.NewRequest("DELETE", srv.URL+"/v1.10/containers/web", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error removing container: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	node.RemoveStatus = http.StatusInternalServerError
+	if status := remove(); status != http.StatusInternalServerError {
+		t.Fatalf("Non-expected status code %v: expected %v", status, http.StatusInternalServerError)
+	}
+	if _, err := findContainerNode(pool, "web", "v1.10"); err != nil {
+		t.Fatalf("Error: expected container to stay indexed after a failed remove ; received: %s", err)
+	}
+	node.RemoveStatus = 0
+	if status := remove(); status != http.StatusNoContent {
+		t.Fatalf("Non-expected status code %v: expected %v", status, http.StatusNoContent)
+	}
+	if _, err := findContainerNode(pool, "web", "v1.10"); err != ErrContainerNotFound {
+		t.Fatalf("Error: expected %v after remove ; received: %v", ErrContainerNotFound, err)
+	}
+}
+
+func TestDockerHandlerProxiesNestedPaths(t *testing.T) {
+	docker := newTestEngineClient(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Proxied", req.Method+" "+req.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	e := &Engine{Name: "local", Zone: "default", Router: mux.NewRouter(), Docker: docker}
+	NewDockerSubrouter(e)
+	srv := httptest.NewServer(e.Router)
+	defer srv.Close()
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/v1.10/images/create"},
+		{"GET", "/v1.10/images/busybox/json"},
+		{"POST", "/v1.10/images/busybox/push"},
+		{"DELETE", "/v1.10/images/busybox"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, srv.URL+test.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error requesting %s: %s", test.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Non-expected status code %v for %s: expected %v", resp.StatusCode, test.path, http.StatusOK)
+		}
+		if expected := test.method + " " + test.path; resp.Header.Get("X-Proxied") != expected {
+			t.Fatalf("Error: expected %s ; received: %s", expected, resp.Header.Get("X-Proxied"))
+		}
+	}
+}
+
+func TestContainerCreateKeepsClientFields(t *testing.T) {
+	pool := newTestPool(t)
+	requests := make(chan map[string]interface{}, 1)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		created := map[string]interface{}{}
+		json.NewDecoder(req.Body).Decode(&created)
+		requests <- created
+		writeJSON(w, http.StatusCreated, map[string]string{"Id": "abc123"})
+	}))
+	defer node.Close()
+	registerTestNode(t, pool, "node1", "default", node.URL)
+
+	e := &Engine{Name: "local", Zone: "default", redisPool: pool, Router: mux.NewRouter(), RunPolicy: &RandomPolicy{RedisPool: pool}}
+	NewDockerSubrouter(e)
+	srv := httptest.NewServer(e.Router)
+	defer srv.Close()
+
+	body := `{"Image": "busybox", "Entrypoint": ["/bin/sh"], "HostConfig": {"Binds": ["/data:/data"]}, "Labels": {"app": "web"}}`
+	resp, err := http.Post(srv.URL+"/v1.10/containers/create?name=web", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error creating container: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Non-expected status code %v: expected %v", resp.StatusCode, http.StatusCreated)
+	}
+	created := <-requests
+	for _, field := range []string{"Entrypoint", "HostConfig", "Labels"} {
+		if _, ok := created[field]; !ok {
+			t.Fatalf("Error: expected %s in the node create request ; received: %v", field, created)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type (
+	DrainResult struct {
+		Container    string
+		Job          string
+		NewContainer string
+		NewNode      string
+		Error        string
+	}
+)
+
+// Returns the node keys of all cordoned nodes
+func getCordonedNodes(pool *redis.Pool) (map[string]bool, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("SMEMBERS", CORDON_KEY))
+	if err != nil {
+		return nil, err
+	}
+	cordoned := make(map[string]bool)
+	for _, k := range keys {
+		cordoned[k] = true
+	}
+	return cordoned, nil
+}
+
+// Marks the node unschedulable for all run policies
+func cordonNode(pool *redis.Pool, nodeKey string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SADD", CORDON_KEY, nodeKey)
+	return err
+}
+
+// Marks the node unschedulable for all run policies
+func (e *Engine) CordonNode(name string, zone string) error {
+	if err := cordonNode(e.redisPool, getNodeKey(name, zone)); err != nil {
+		return err
+	}
+	log.Printf("Cordoned node %s in zone %s", name, zone)
+	return nil
+}
+
+// Marks the node schedulable
+func (e *Engine) UncordonNode(name string, zone string) error {
+	conn := e.redisPool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SREM", CORDON_KEY, getNodeKey(name, zone)); err != nil {
+		return err
+	}
+	log.Printf("Uncordoned node %s in zone %s", name, zone)
+	return nil
+}
+
+// Cordons the node and moves its hive managed containers to other nodes
+// in the zone ; the move is performed by the master
+func (e *Engine) DrainNode(name string, zone string) ([]*DrainResult, error) {
+	if term, master := e.MasterTerm(); master {
+		return e.Scheduler.DrainNode(getNodeKey(name, zone), term)
+	}
+	results := []*DrainResult{}
+	path := fmt.Sprintf("/hive/nodes/%s/%s/drain", url.PathEscape(zone), url.PathEscape(name))
+	if err := masterRequest(e.redisPool, "POST", path, &results); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+// Cordons the node and moves its hive managed containers to other nodes
+// in the zone
+func (s *DefaultScheduler) DrainNode(nodeKey string, term int64) ([]*DrainResult, error) {
+	// prevent the reconciler from placing instances while moving
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	results := []*DrainResult{}
+	if !isMasterTerm(s.RedisPool, s.NodeName, term) {
+		return results, ErrNotMaster
+	}
+	zone, name := parseNodeKey(nodeKey)
+	n, err := getNode(s.RedisPool, nodeKey)
+	if err != nil {
+		return results, fmt.Errorf("Node %s not found in zone %s", name, zone)
+	}
+	if err := cordonNode(s.RedisPool, nodeKey); err != nil {
+		return results, err
+	}
+	jobs, err := s.getNodeJobInstances(nodeKey)
+	if err != nil {
+		return results, err
+	}
+	containers := []APIContainer{}
+	if err := getNodeJSON(n, fmt.Sprintf("/%s/containers/json?all=1", DOCKER_API_VERSION), &containers); err != nil {
+		return results, err
+	}
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	for _, c := range containers {
+		managed, err := redis.Bool(conn.Do("SISMEMBER", MANAGED_CONTAINERS_KEY, c.Id))
+		if err != nil || !managed {
+			continue
+		}
+		if !isMasterTerm(s.RedisPool, s.NodeName, term) {
+			return results, ErrNotMaster
+		}
+		r := &DrainResult{Container: c.Id, Job: jobs[c.Id]}
+		if err := s.moveContainer(n, c.Id, term, r); err != nil {
+			log.Printf("Error moving container %s from node %s: %s", c.Id, n.Name, err)
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+	}
+	log.Printf("Drained node %s in zone %s", name, zone)
+	return results, nil
+}
+
+// Returns the job of each job instance on the node keyed by container id
+func (s *DefaultScheduler) getNodeJobInstances(nodeKey string) (map[string]string, error) {
+	jobs, err := s.ListContainerJobs()
+	if err != nil {
+		return nil, err
+	}
+	instances := make(map[string]string)
+	for _, j := range jobs {
+		ids, err := s.getJobInstances(j.Config.Name)
+		if err != nil {
+			return nil, err
+		}
+		for id, k := range ids {
+			if k == nodeKey {
+				instances[id] = j.Config.Name
+			}
+		}
+	}
+	return instances, nil
+}
+
+// Creates a replacement for the container on another node and removes
+// the original
+func (s *DefaultScheduler) moveContainer(n *Node, id string, term int64, r *DrainResult) error {
+	var config ContainerConfig
+	var hostConfig *HostConfig
+	name := ""
+	if r.Job != "" {
+		// job instances are placed from the job so its zone and
+		// constraints are kept
+		j, err := s.GetContainerJob(r.Job)
+		if err != nil {
+			return err
+		}
+		config = *j.Config
+		if config.Zone == "" {
+			config.Zone = j.Zone
+		}
+		hostConfig = j.HostConfig
+	} else {
+		c, err := inspectContainer(n, DOCKER_API_VERSION, id)
+		if err != nil {
+			return err
+		}
+		config = c.Config
+		config.Zone = n.Zone
+		hostConfig = &c.HostConfig
+		name = strings.TrimPrefix(c.Name, "/")
+		// Docker sets the hostname to the short container id
+		if config.Hostname != "" && strings.HasPrefix(id, config.Hostname) {
+			config.Hostname = ""
+		}
+	}
+	config.NumberOfInstances = 1
+	check := func() error {
+		return s.checkTerm(term)
+	}
+	containers, err := placeContainers(s.RedisPool, s.RunPolicy, &config, name, s.creator(&config), check)
+	if err != nil {
+		return err
+	}
+	replacement := containers[0]
+	newKey := getNodeKey(replacement.Node, replacement.Zone)
+	r.NewContainer = replacement.Id
+	r.NewNode = replacement.Node
+	newNode, err := getNode(s.RedisPool, newKey)
+	if err != nil {
+		return err
+	}
+	if r.Job != "" {
+		if err := s.addJobInstance(term, r.Job, replacement.Id, newKey); err != nil {
+			// the new master does not know about the replacement
+			removeContainer(newNode, DOCKER_API_VERSION, replacement.Id)
+			return err
+		}
+	}
+	if err := s.startContainer(newNode, replacement.Id, hostConfig); err != nil {
+		return err
+	}
+	if err := s.checkTerm(term); err != nil {
+		return err
+	}
+	if r.Job != "" {
+		if err := s.removeJobInstance(term, r.Job, id); err != nil {
+			return err
+		}
+		recordJobEvent(s.RedisPool, r.Job, replacement.Id, newKey, JOB_STATE_RUNNING, fmt.Sprintf("moved from node %s", n.Name))
+		recordJobEvent(s.RedisPool, r.Job, id, getNodeKey(n.Name, n.Zone), JOB_STATE_REMOVED, "node drained")
+	}
+	if err := removeContainer(n, DOCKER_API_VERSION, id); err != nil {
+		return err
+	}
+	unindexContainer(s.RedisPool, id)
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"testing"
+)
+
+func TestDrainNodeMovesJobInstances(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node1 := newFakeNode(t, s.RedisPool, "node1", "default")
+	node2 := newFakeNode(t, s.RedisPool, "node2", "default")
+	addTestJob(t, s, term, node1, 1)
+
+	results, err := s.DrainNode(getNodeKey("node1", "default"), term)
+	if err != nil {
+		t.Fatalf("Error draining node: %s", err)
+	}
+	if len(results) != 1 || results[0].Error != "" || results[0].Job != "web" {
+		t.Fatalf("Error: expected 1 moved job instance ; received: %+v", results)
+	}
+	if results[0].NewNode != "node2" {
+		t.Fatalf("Error: expected instance moved to node2 ; received: %s", results[0].NewNode)
+	}
+	if removed := node1.Removed(); len(removed) != 1 || removed[0] != "node1-web" {
+		t.Fatalf("Error: expected node1-web removed ; received: %v", removed)
+	}
+	instances, err := s.getJobInstances("web")
+	if err != nil {
+		t.Fatalf("Error getting job instances: %s", err)
+	}
+	if len(instances) != 1 || instances[results[0].NewContainer] != getNodeKey("node2", "default") {
+		t.Fatalf("Error: expected instance on node2 ; received: %v", instances)
+	}
+	if containers := node2.Containers(); len(containers) != 1 {
+		t.Fatalf("Error: expected 1 container on node2 ; received: %v", containers)
+	}
+}
+
+func TestDrainNodeRequiresMaster(t *testing.T) {
+	s, term := newTestScheduler(t)
+	newFakeNode(t, s.RedisPool, "node1", "default")
+	if _, err := s.DrainNode(getNodeKey("node1", "default"), term+1); err != ErrNotMaster {
+		t.Fatalf("Error: expected %s ; received: %v", ErrNotMaster, err)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	ErrNotMaster = errors.New("Node is not the master")
+
+	// Sets the master key if missing and starts a new term
+	acquireMasterScript = redis.NewScript(2, `
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return redis.call("INCR", KEYS[2])
+end
+return 0
+`)
+
+	// Extends the master key if owned and returns the current term
+	renewMasterScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return tonumber(redis.call("GET", KEYS[2]) or "0")
+end
+return 0
+`)
+
+	// Deletes the master key if owned
+	resignMasterScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+	// Sets or deletes a hash field if the master key is owned for the term
+	fencedHashScript = redis.NewScript(3, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] or redis.call("GET", KEYS[2]) ~= ARGV[2] then
+	return -1
+end
+if ARGV[3] == "HSET" then
+	return redis.call("HSET", KEYS[3], ARGV[4], ARGV[5])
+end
+return redis.call("HDEL", KEYS[3], ARGV[4])
+`)
+
+	// Removes a node from the zone index and the container counts if the
+	// master key is owned for the term ; empty zones are removed
+	fencedRemoveNodeScript = redis.NewScript(5, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] or redis.call("GET", KEYS[2]) ~= ARGV[2] then
+	return -1
+end
+redis.call("ZREM", KEYS[3], ARGV[3])
+redis.call("HDEL", KEYS[4], ARGV[4])
+if redis.call("ZCARD", KEYS[3]) == 0 then
+	redis.call("SREM", KEYS[5], ARGV[5])
+end
+return 1
+`)
+
+	// Returns 1 if the master key is owned for the term
+	checkMasterScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[1]) == ARGV[1] and redis.call("GET", KEYS[2]) == ARGV[2] then
+	return 1
+end
+return 0
+`)
+)
+
+// Renews or acquires mastership for the node ; returns the term (fencing
+// token) or 0 if another node is master
+func electMaster(pool *redis.Pool, name string) (int64, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	ttl := (MASTER_HEARTBEAT_INTERVAL + 1) * 1000
+	term, err := redis.Int64(renewMasterScript.Do(conn, MASTER_KEY, MASTER_TERM_KEY, name, ttl))
+	if err != nil || term > 0 {
+		return term, err
+	}
+	return redis.Int64(acquireMasterScript.Do(conn, MASTER_KEY, MASTER_TERM_KEY, name, ttl))
+}
+
+// Releases mastership if held by the node
+func resignMaster(pool *redis.Pool, name string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := resignMasterScript.Do(conn, MASTER_KEY, name)
+	return err
+}
+
+// Returns true if the node is still master for the term
+func isMasterTerm(pool *redis.Pool, name string, term int64) bool {
+	if term <= 0 {
+		return false
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	ok, err := redis.Bool(checkMasterScript.Do(conn, MASTER_KEY, MASTER_TERM_KEY, name, term))
+	return err == nil && ok
+}
+
+// Sets the hash field if the node is still master for the term
+func fencedHSet(pool *redis.Pool, name string, term int64, key string, field string, value string) error {
+	return fencedHash(pool, name, term, "HSET", key, field, value)
+}
+
+// Deletes the hash field if the node is still master for the term
+func fencedHDel(pool *redis.Pool, name string, term int64, key string, field string) error {
+	return fencedHash(pool, name, term, "HDEL", key, field, "")
+}
+
+func fencedHash(pool *redis.Pool, name string, term int64, op string, key string, field string, value string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	r, err := redis.Int(fencedHashScript.Do(conn, MASTER_KEY, MASTER_TERM_KEY, key, name, term, op, field, value))
+	if err != nil {
+		return err
+	}
+	if r < 0 {
+		return ErrNotMaster
+	}
+	return nil
+}
+
+// Removes the node from the cluster indexes if the node is still master
+// for the term
+func fencedRemoveNode(pool *redis.Pool, name string, term int64, nodeKey string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	zone, node := parseNodeKey(nodeKey)
+	r, err := redis.Int(fencedRemoveNodeScript.Do(conn, MASTER_KEY, MASTER_TERM_KEY, getZoneKey(zone), CONTAINER_COUNT_KEY, ZONE_KEY,
+		name, term, node, nodeKey, zone))
+	if err != nil {
+		return err
+	}
+	if r < 0 {
+		return ErrNotMaster
+	}
+	return nil
+}
+
+// Returns the name and term of the current master
+func getMaster(pool *redis.Pool) (string, int64, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	v, err := redis.Values(conn.Do("MGET", MASTER_KEY, MASTER_TERM_KEY))
+	if err != nil {
+		return "", 0, err
+	}
+	var name string
+	var term int64
+	if _, err := redis.Scan(v, &name, &term); err != nil {
+		return "", 0, err
+	}
+	return name, term, nil
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestElectMasterHeldByOtherNode(t *testing.T) {
+	pool := newTestPool(t)
+	term, err := electMaster(pool, "node1")
+	if err != nil || term == 0 {
+		t.Fatalf("Error electing master: %v", err)
+	}
+	other, err := electMaster(pool, "node2")
+	if err != nil {
+		t.Fatalf("Error electing master: %s", err)
+	}
+	if other != 0 {
+		t.Fatalf("Error: expected term 0 for node2 ; received: %d", other)
+	}
+	name, current, err := getMaster(pool)
+	if err != nil {
+		t.Fatalf("Error getting master: %s", err)
+	}
+	if name != "node1" || current != term {
+		t.Fatalf("Error: expected node1 at term %d ; received: %s at term %d", term, name, current)
+	}
+}
+
+func TestElectMasterRenewKeepsTerm(t *testing.T) {
+	pool := newTestPool(t)
+	term, err := electMaster(pool, "node1")
+	if err != nil || term == 0 {
+		t.Fatalf("Error electing master: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		renewed, err := electMaster(pool, "node1")
+		if err != nil {
+			t.Fatalf("Error renewing master: %s", err)
+		}
+		if renewed != term {
+			t.Fatalf("Error: expected term %d ; received: %d", term, renewed)
+		}
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	renewed, err := redis.Int64(renewMasterScript.Do(conn, MASTER_KEY, MASTER_TERM_KEY, "node2", 1000))
+	if err != nil {
+		t.Fatalf("Error renewing master: %s", err)
+	}
+	if renewed != 0 {
+		t.Fatalf("Error: expected term 0 for node2 ; received: %v", renewed)
+	}
+}
+
+func TestElectMasterTermIncreases(t *testing.T) {
+	pool := newTestPool(t)
+	var last int64
+	for _, name := range []string{"node1", "node2", "node1"} {
+		term, err := electMaster(pool, name)
+		if err != nil {
+			t.Fatalf("Error electing master: %s", err)
+		}
+		if term <= last {
+			t.Fatalf("Error: expected term greater than %d for %s ; received: %d", last, name, term)
+		}
+		last = term
+		if err := resignMaster(pool, name); err != nil {
+			t.Fatalf("Error resigning master: %s", err)
+		}
+	}
+	// the key expiring counts as a fresh acquire
+	term, err := electMaster(pool, "node1")
+	if err != nil {
+		t.Fatalf("Error electing master: %s", err)
+	}
+	conn := pool.Get()
+	conn.Do("DEL", MASTER_KEY)
+	conn.Close()
+	expired, err := electMaster(pool, "node1")
+	if err != nil {
+		t.Fatalf("Error electing master: %s", err)
+	}
+	if expired <= term {
+		t.Fatalf("Error: expected term greater than %d ; received: %d", term, expired)
+	}
+}
+
+func TestResignMasterByOtherNode(t *testing.T) {
+	pool := newTestPool(t)
+	term, err := electMaster(pool, "node1")
+	if err != nil || term == 0 {
+		t.Fatalf("Error electing master: %v", err)
+	}
+	if err := resignMaster(pool, "node2"); err != nil {
+		t.Fatalf("Error resigning master: %s", err)
+	}
+	if !isMasterTerm(pool, "node1", term) {
+		t.Fatalf("Error: expected node1 to remain master for term %d", term)
+	}
+	if err := resignMaster(pool, "node1"); err != nil {
+		t.Fatalf("Error resigning master: %s", err)
+	}
+	if isMasterTerm(pool, "node1", term) {
+		t.Fatalf("Error: expected node1 to no longer be master")
+	}
+}
@@ -16,15 +16,20 @@
 package hive
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/ehazlett/docker-hive/utils"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/mux"
 )
@@ -38,12 +43,27 @@ type (
 		waiter     *sync.WaitGroup
 		redisPool  *redis.Pool
 		Router     *mux.Router
-		DockerPath string
+		Docker     *EngineClient
 		Version    string
 		Zone       string
+		Labels     map[string]string
 		RunPolicy  RunPolicy
 		Scheduler  Scheduler
 		Master     bool
+		resources  *NodeResources
+		term       int64
+		startedAt  time.Time
+		containers int
+		dockerVer  string
+		observers  []MasterObserver
+		lock       sync.Mutex
+		masterLock sync.Mutex
+		stopping   bool
+		requests   sync.WaitGroup
+		tasks      sync.WaitGroup
+		stop       chan struct{}
+		runDone    chan struct{}
+		stopOnce   sync.Once
 	}
 	Image struct {
 		Id          string
@@ -53,6 +73,12 @@ type (
 		VirtualSize int
 	}
 
+	ClusterImage struct {
+		Image
+		Nodes []string
+		Zones []string
+	}
+
 	InfoPort struct {
 		IP          string
 		PrivatePort int
@@ -77,7 +103,7 @@ type (
 )
 
 // Creates a new Engine
-func NewEngine(host string, port int, dockerPath string, version string, nodeName string, zone string, redisPool *redis.Pool, runPolicy string) *Engine {
+func NewEngine(host string, port int, docker *utils.DockerClient, version string, nodeName string, zone string, labels map[string]string, redisPool *redis.Pool, runPolicy string) *Engine {
 	// select launch policy
 	var rp RunPolicy
 	switch runPolicy {
@@ -85,23 +111,31 @@ func NewEngine(host string, port int, dockerPath string, version string, nodeNam
 		rp = &RandomPolicy{RedisPool: redisPool}
 	case "unique":
 		rp = &UniquePolicy{RedisPool: redisPool}
+	case "binpack":
+		rp = &BinpackPolicy{RedisPool: redisPool}
+	case "spread":
+		rp = &SpreadPolicy{RedisPool: redisPool}
 	}
 	// scheduler
-	scheduler := &DefaultScheduler{RedisPool: redisPool}
+	client := NewEngineClient(docker)
+	scheduler := &DefaultScheduler{RedisPool: redisPool, RunPolicy: rp, NodeName: nodeName, Zone: zone, Docker: client}
 
 	e := &Engine{
-		Name:       nodeName,
-		Host:       host,
-		Port:       port,
-		DockerPath: dockerPath,
-		waiter:     new(sync.WaitGroup),
-		redisPool:  redisPool,
-		Router:     mux.NewRouter(),
-		Version:    version,
-		Zone:       zone,
-		RunPolicy:  rp,
-		Scheduler:  scheduler,
-		Master:     false,
+		Name:      nodeName,
+		Host:      host,
+		Port:      port,
+		Docker:    client,
+		waiter:    new(sync.WaitGroup),
+		redisPool: redisPool,
+		Router:    mux.NewRouter(),
+		Version:   version,
+		Zone:      zone,
+		Labels:    labels,
+		RunPolicy: rp,
+		Scheduler: scheduler,
+		Master:    false,
+		stop:      make(chan struct{}),
+		runDone:   make(chan struct{}),
 	}
 
 	// check for empty host
@@ -126,12 +160,13 @@ func NewEngine(host string, port int, dockerPath string, version string, nodeNam
 
 // Starts the Engine
 func (e *Engine) Start() (*sync.WaitGroup, error) {
+	e.startedAt = time.Now()
 	log.Println("Initializing HTTP API")
 
 	// Initialize and start HTTP server.
 	e.httpServer = &http.Server{
 		Addr:    fmt.Sprintf(":%d", e.Port),
-		Handler: e.Router,
+		Handler: e.trackRequests(e.Router),
 	}
 
 	// docker router
@@ -139,13 +174,29 @@ func (e *Engine) Start() (*sync.WaitGroup, error) {
 
 	// setup router
 	e.Router.HandleFunc("/ping", e.pingHandler).Methods("GET").Name("ping")
+	// hive api
+	e.registerApiHandlers()
+
+	// master only tasks
+	e.AddMasterObserver(&MasterTask{
+		Name:     "scheduler",
+		Interval: JOB_INTERVAL * time.Second,
+		Run:      e.reconcileJobs,
+	})
+	e.AddMasterObserver(&MasterTask{
+		Name:     "node reaper",
+		Interval: NODE_REAPER_INTERVAL * time.Second,
+		Run:      e.reapNodes,
+	})
 	// addon docker router
 	e.Router.Handle("/{apiVersion:v1.*}", dockerRouter.Subrouter).Methods("GET", "PUT", "POST", "DELETE")
 	// index
 	e.Router.HandleFunc("/", e.indexHandler).Methods("GET")
 
 	log.Printf("Server name: %s", e.Name)
+	log.Printf("Docker: %s", e.Docker.Endpoint)
 	log.Printf("Zone: %s", e.Zone)
+	log.Printf("Labels: %v", e.Labels)
 	log.Printf("Run Policy: %s", e.RunPolicy.Name())
 	log.Printf("Listening at: %s", e.ConnectionString())
 
@@ -163,36 +214,164 @@ func (e *Engine) ConnectionString() string {
 
 // Stops the Engine
 func (e *Engine) Stop() {
+	e.stopOnce.Do(e.shutdown)
+}
+
+func (e *Engine) shutdown() {
 	log.Println("Stopping server")
+	// hand off mastership first so another node can take over
+	e.releaseMaster()
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT*time.Second)
+	defer cancel()
+	if err := e.httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Error waiting for requests to finish: %s", err)
+	}
+	// Shutdown does not track hijacked connections (i.e. attach and exec)
+	if err := waitContext(ctx, &e.requests); err != nil {
+		log.Printf("Error waiting for connections to close: %s", err)
+	}
+	// stop periodic tasks so a heartbeat does not register the node again
+	close(e.stop)
+	<-e.runDone
+	e.tasks.Wait()
+	e.deregisterNode()
 	e.waiter.Done()
 }
 
+// Tracks in-flight requests including hijacked connections
+func (e *Engine) trackRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		e.requests.Add(1)
+		defer e.requests.Done()
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Waits for the wait group until the context is done
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stops master tasks and releases the master key if held
+func (e *Engine) releaseMaster() {
+	e.masterLock.Lock()
+	defer e.masterLock.Unlock()
+	e.stopping = true
+	e.lock.Lock()
+	term := e.term
+	e.Master = false
+	e.term = 0
+	e.lock.Unlock()
+	if term == 0 {
+		return
+	}
+	e.notifyMasterChange(term, 0)
+	if err := resignMaster(e.redisPool, e.Name); err != nil {
+		log.Printf("Error releasing master role: %s", err)
+		return
+	}
+	log.Printf("Released master role (term %d)", term)
+}
+
+// Removes the node from the cluster
+func (e *Engine) deregisterNode() {
+	conn := e.redisPool.Get()
+	defer conn.Close()
+	conn.Do("DEL", getNodeKey(e.Name, e.Zone), getResourcesKey(e.Name, e.Zone), getLabelsKey(e.Name, e.Zone))
+	removeNode(conn, getNodeKey(e.Name, e.Zone))
+}
+
 // Checks for master node ; self-elects if missing
 func (e *Engine) checkMasterStatus() {
-	conn := e.redisPool.Get()
-	master, err := redis.String(conn.Do("GET", MASTER_KEY))
+	// serialize elections so observers see ordered transitions
+	e.masterLock.Lock()
+	defer e.masterLock.Unlock()
+	if e.stopping {
+		return
+	}
+	term, err := electMaster(e.redisPool, e.Name)
 	if err != nil {
-		log.Printf("Assuming master role")
-		conn.Do("SET", MASTER_KEY, e.Name)
-		// set expiration to avoid the race condition between set
-		// and expiring if server crashes
-		conn.Do("EXPIRE", MASTER_KEY, MASTER_HEARTBEAT_INTERVAL+1)
+		log.Printf("Error checking master status: %s", err)
 	}
-	// update master heartbeat
-	if master == e.Name {
-		conn.Do("EXPIRE", MASTER_KEY, MASTER_HEARTBEAT_INTERVAL+1)
-		e.Master = true
-	} else {
-		e.Master = false
+	e.lock.Lock()
+	oldTerm := e.term
+	if term > 0 && term != oldTerm {
+		log.Printf("Assuming master role (term %d)", term)
 	}
+	if term == 0 && oldTerm > 0 {
+		log.Printf("Lost master role (term %d)", oldTerm)
+	}
+	e.Master = term > 0
+	e.term = term
+	e.lock.Unlock()
+	if term != oldTerm {
+		e.notifyMasterChange(oldTerm, term)
+	}
+}
+
+// Returns the master term (fencing token) if the node is master
+func (e *Engine) MasterTerm() (int64, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.term, e.Master
+}
+
+// Removes the container job on the master
+func (e *Engine) RemoveContainerJob(id string) ([]*InstanceResult, error) {
+	if term, master := e.MasterTerm(); master {
+		return e.Scheduler.RemoveContainerJob(id, term)
+	}
+	results := []*InstanceResult{}
+	path := fmt.Sprintf("/hive/jobs/containers/%s", url.PathEscape(id))
+	if err := masterRequest(e.redisPool, "DELETE", path, &results); err != nil {
+		return results, err
+	}
+	return results, nil
 }
 
 // Updates node heartbeat ttl
 func (e *Engine) nodeHeartbeat() {
 	key := getNodeKey(e.Name, e.Zone)
+	n := e.nodeRecord()
+	data, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("Error encoding node record: %s", err)
+		return
+	}
 	conn := e.redisPool.Get()
-	conn.Do("SET", key, e.ConnectionString())
-	conn.Do("EXPIRE", key, 5)
+	defer conn.Close()
+	conn.Do("SET", key, data)
+	conn.Do("EXPIRE", key, NODE_TTL)
+	indexNode(conn, e.Name, e.Zone, n.LastHeartbeat)
+	e.publishResources(conn)
+	e.publishLabels(conn)
+}
+
+// Publishes the node labels
+func (e *Engine) publishLabels(conn redis.Conn) {
+	if len(e.Labels) == 0 {
+		return
+	}
+	key := getLabelsKey(e.Name, e.Zone)
+	conn.Do("HMSET", redis.Args{}.Add(key).AddFlat(e.Labels)...)
+	conn.Do("EXPIRE", key, NODE_TTL)
+}
+
+// Converges container jobs to their desired state
+func (e *Engine) reconcileJobs(term int64) {
+	if err := e.Scheduler.Reconcile(term); err != nil {
+		log.Printf("Error reconciling jobs: %s", err)
+	}
 }
 
 // ---- Handlers ----
@@ -207,35 +386,67 @@ func (e *Engine) pingHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("pong"))
 }
 
-// Generic error handler
+// Generic error handler ; errors use the Docker JSON format so Docker
+// clients show the message
 func handlerError(msg string, status int, w http.ResponseWriter) {
-	w.WriteHeader(status)
-	w.Write([]byte(msg))
+	utils.WriteError(w, status, msg)
 }
 
 func (e *Engine) listenAndServe() {
 	go func() {
-		e.httpServer.ListenAndServe()
+		if err := e.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving HTTP: %s", err)
+		}
 	}()
 }
 
 func (e *Engine) run() {
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	if e.loop(sig) {
+		e.Stop()
+	}
+}
 
-	heartbeatTick := time.Tick(NODE_HEARTBEAT_INTERVAL * time.Second)
-	masterTick := time.Tick(MASTER_HEARTBEAT_INTERVAL * time.Second)
+// Runs the periodic node tasks ; returns true if a signal was received and
+// false if the engine was stopped
+func (e *Engine) loop(sig chan os.Signal) bool {
+	defer close(e.runDone)
+	heartbeatTick := time.NewTicker(NODE_HEARTBEAT_INTERVAL * time.Second)
+	defer heartbeatTick.Stop()
+	masterTick := time.NewTicker(MASTER_HEARTBEAT_INTERVAL * time.Second)
+	defer masterTick.Stop()
+	indexTick := time.NewTicker(CONTAINER_INDEX_INTERVAL * time.Second)
+	defer indexTick.Stop()
+	jobTick := time.NewTicker(JOB_INTERVAL * time.Second)
+	defer jobTick.Stop()
 
-run:
 	for {
 		select {
-		case <-masterTick:
-			go e.checkMasterStatus()
-		case <-heartbeatTick:
-			go e.nodeHeartbeat()
+		case <-masterTick.C:
+			e.runTask(e.checkMasterStatus)
+		case <-heartbeatTick.C:
+			e.runTask(e.nodeHeartbeat)
+		case <-indexTick.C:
+			e.runTask(e.indexContainers)
+			e.runTask(e.updateResources)
+			e.runTask(e.updateDockerVersion)
+		case <-jobTick.C:
+			e.runTask(e.processImageJobs)
 		case <-sig:
-			break run
+			return true
+		case <-e.stop:
+			return false
 		}
 	}
-	e.Stop()
+}
+
+// Runs the task in the background ; Stop waits for running tasks
+func (e *Engine) runTask(fn func()) {
+	e.tasks.Add(1)
+	go func() {
+		defer e.tasks.Done()
+		fn()
+	}()
 }
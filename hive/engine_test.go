@@ -18,10 +18,12 @@ package hive
 import (
 	"fmt"
 	_ "log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/ehazlett/docker-hive/utils"
 )
@@ -32,13 +34,18 @@ var (
 	testAddress = fmt.Sprintf("http://localhost:%d", listenPort)
 )
 
-func newTestEngine() *Engine {
+func newTestEngine(t *testing.T) *Engine {
 	dockerPath := os.Getenv("DOCKER_PATH")
 	if dockerPath == "" {
 		dockerPath = "/var/run/docker.sock"
 	}
+	endpoint, err := utils.ParseDockerEndpoint(dockerPath, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docker := utils.NewDockerClient(endpoint, utils.DEFAULT_DOCKER_DIAL_TIMEOUT*time.Second, utils.DEFAULT_DOCKER_TIMEOUT*time.Second)
 	pool := utils.NewRedisPool("127.0.0.1", 6379, "")
-	testEngine := NewEngine("", listenPort, dockerPath, "test", nodeName, "default", pool, "default")
+	testEngine := NewEngine("", listenPort, docker, "test", nodeName, "default", nil, pool, "default")
 	testEngine.Start()
 	return testEngine
 }
@@ -51,7 +58,7 @@ func TestHandleIndexReturnsWithStatusOK(t *testing.T) {
 	request, _ := http.NewRequest("GET", getTestUrl("/"), nil)
 	response := httptest.NewRecorder()
 
-	testEngine := newTestEngine()
+	testEngine := newTestEngine(t)
 	testEngine.indexHandler(response, request)
 
 	if response.Code != http.StatusOK {
@@ -63,10 +70,70 @@ func TestHandlePingReturnsWithStatusOK(t *testing.T) {
 	request, _ := http.NewRequest("GET", getTestUrl("/ping"), nil)
 	response := httptest.NewRecorder()
 
-	testEngine := newTestEngine()
+	testEngine := newTestEngine(t)
 	testEngine.indexHandler(response, request)
 
 	if response.Code != http.StatusOK {
 		t.Fatalf("Non-expected status code %v: expected %v\nbody: %v", response.Code, "200", response.Body)
 	}
 }
+
+func TestStopWaitsForHijackedConnections(t *testing.T) {
+	pool := newTestPool(t)
+	endpoint := &utils.DockerEndpoint{Network: "unix", Addr: "/nonexistent/docker.sock"}
+	docker := utils.NewDockerClient(endpoint, time.Second, time.Second)
+	e := NewEngine("localhost", 0, docker, "test", "node1", "default", nil, pool, "default")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	e.Router.HandleFunc("/attach", func(w http.ResponseWriter, req *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Error hijacking connection: %s", err)
+			return
+		}
+		defer conn.Close()
+		close(started)
+		<-release
+	})
+	srv := httptest.NewUnstartedServer(e.trackRequests(e.Router))
+	srv.Start()
+	defer srv.Close()
+	e.httpServer = srv.Config
+	e.waiter.Add(1)
+	go e.run()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /attach HTTP/1.1\r\nHost: hive\r\n\r\n"))
+	<-started
+	// wait for a heartbeat to register the node
+	time.Sleep((NODE_HEARTBEAT_INTERVAL + 1) * time.Second)
+	if _, err := getNode(pool, getNodeKey("node1", "default")); err != nil {
+		t.Fatalf("Error: expected node registered ; received: %s", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		e.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatalf("Error: expected stop to wait for the hijacked connection")
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Error: expected stop after the hijacked connection closed")
+	}
+	// the node must stay deregistered once stopped
+	time.Sleep((NODE_HEARTBEAT_INTERVAL + 1) * time.Second)
+	if _, err := getNode(pool, getNodeKey("node1", "default")); err == nil {
+		t.Fatalf("Error: expected node deregistered after stop")
+	}
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	JOB_STATE_SCHEDULED = "scheduled"
+	JOB_STATE_RUNNING   = "running"
+	JOB_STATE_FAILED    = "failed"
+	JOB_STATE_LOST      = "lost"
+	JOB_STATE_REMOVED   = "removed"
+)
+
+type (
+	JobEvent struct {
+		State   string
+		Time    time.Time
+		Message string
+	}
+
+	// Job history list entry
+	jobHistoryEntry struct {
+		Container string
+		Node      string
+		Zone      string
+		JobEvent
+	}
+
+	jobInstancesByCreated []*JobInstance
+)
+
+func (j jobInstancesByCreated) Len() int           { return len(j) }
+func (j jobInstancesByCreated) Less(i, k int) bool { return j[i].Created.Before(j[k].Created) }
+func (j jobInstancesByCreated) Swap(i, k int)      { j[i], j[k] = j[k], j[i] }
+
+// Returns job history key
+func getJobHistoryKey(job string) string {
+	return fmt.Sprintf("%s:%s", JOB_HISTORY_KEY, job)
+}
+
+// Records a state transition for a job instance ; only the latest
+// JOB_HISTORY_LIMIT events are kept for each job
+func recordJobEvent(pool *redis.Pool, job string, id string, nodeKey string, state string, msg string) {
+	zone, name := parseNodeKey(nodeKey)
+	data, err := json.Marshal(&jobHistoryEntry{
+		Container: id,
+		Node:      name,
+		Zone:      zone,
+		JobEvent: JobEvent{
+			State:   state,
+			Time:    time.Now(),
+			Message: msg,
+		},
+	})
+	if err != nil {
+		return
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	key := getJobHistoryKey(job)
+	conn.Send("RPUSH", key, data)
+	conn.Send("LTRIM", key, -JOB_HISTORY_LIMIT, -1)
+	conn.Flush()
+}
+
+// Returns all tracked instances of the job sorted by creation
+func getJobHistory(pool *redis.Pool, job string) ([]*JobInstance, error) {
+	instances := []*JobInstance{}
+	conn := pool.Get()
+	defer conn.Close()
+	entries, err := redis.ByteSlices(conn.Do("LRANGE", getJobHistoryKey(job), 0, -1))
+	if err != nil {
+		return instances, err
+	}
+	index := make(map[string]*JobInstance)
+	for _, data := range entries {
+		e := &jobHistoryEntry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			continue
+		}
+		i, ok := index[e.Container]
+		if !ok {
+			i = &JobInstance{
+				Job:       job,
+				Container: e.Container,
+				Node:      e.Node,
+				Zone:      e.Zone,
+				Created:   e.Time,
+			}
+			index[e.Container] = i
+			instances = append(instances, i)
+		}
+		event := e.JobEvent
+		i.State = event.State
+		i.Updated = event.Time
+		i.History = append(i.History, &event)
+	}
+	sort.Stable(jobInstancesByCreated(instances))
+	return instances, nil
+}
+
+// Expires the history of a removed job after JOB_HISTORY_TTL
+func expireJobHistory(pool *redis.Pool, job string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("EXPIRE", getJobHistoryKey(job), JOB_HISTORY_TTL)
+	return err
+}
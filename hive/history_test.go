@@ -0,0 +1,70 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestGetJobHistory(t *testing.T) {
+	pool := newTestPool(t)
+	nodeKey := getNodeKey("node1", "default")
+	recordJobEvent(pool, "web", "c1", nodeKey, JOB_STATE_SCHEDULED, "")
+	recordJobEvent(pool, "web", "c2", nodeKey, JOB_STATE_SCHEDULED, "")
+	recordJobEvent(pool, "web", "c1", nodeKey, JOB_STATE_RUNNING, "")
+	recordJobEvent(pool, "db", "c3", nodeKey, JOB_STATE_SCHEDULED, "")
+	history, err := getJobHistory(pool, "web")
+	if err != nil {
+		t.Fatalf("Error getting job history: %s", err)
+	}
+	if len(history) != 2 || history[0].Container != "c1" || history[1].Container != "c2" {
+		t.Fatalf("Error: expected instances c1 and c2 ; received: %v", history)
+	}
+	if history[0].State != JOB_STATE_RUNNING || len(history[0].History) != 2 {
+		t.Fatalf("Error: expected c1 running with 2 events ; received: %+v", history[0])
+	}
+	if history[0].Node != "node1" || history[0].Zone != "default" {
+		t.Fatalf("Error: expected c1 on node1 in default ; received: %+v", history[0])
+	}
+}
+
+func TestContainerJobHistoryAfterRemoval(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node := newFakeNode(t, s.RedisPool, "node1", "default")
+	addTestJob(t, s, term, node, 1)
+	recordJobEvent(s.RedisPool, "web", "node1-web", getNodeKey("node1", "default"), JOB_STATE_RUNNING, "")
+	if _, err := s.RemoveContainerJob("web", term); err != nil {
+		t.Fatalf("Error removing job: %s", err)
+	}
+	history, err := s.ContainerJobHistory("web")
+	if err != nil {
+		t.Fatalf("Error getting job history: %s", err)
+	}
+	if len(history) != 1 || history[0].State != JOB_STATE_REMOVED {
+		t.Fatalf("Error: expected removed instance in history ; received: %v", history)
+	}
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	ttl, err := redis.Int(conn.Do("TTL", getJobHistoryKey("web")))
+	if err != nil || ttl <= 0 {
+		t.Fatalf("Error: expected history to expire ; received: %d %v", ttl, err)
+	}
+	if _, err := s.ContainerJobHistory("db"); err != ErrJobNotFound {
+		t.Fatalf("Error: expected %v ; received: %v", ErrJobNotFound, err)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	IMAGE_STATUS_PENDING = "pending"
+	IMAGE_STATUS_PULLING = "pulling"
+	IMAGE_STATUS_DONE    = "done"
+	IMAGE_STATUS_FAILED  = "failed"
+)
+
+// Returns the id for an image job
+func getImageJobId(j *ImageJob) string {
+	return fmt.Sprintf("%s:%s", j.Zone, j.Image)
+}
+
+// Returns image job key
+func getImageJobKey(id string) string {
+	return fmt.Sprintf("%s:%s", IMAGE_JOB_KEY, id)
+}
+
+// Returns image job status key
+func getImageJobStatusKey(id string) string {
+	return fmt.Sprintf("%s:%s", IMAGE_JOB_STATUS_KEY, id)
+}
+
+// Returns image job pulls key ; pull start times for each node
+func getImageJobPullsKey(id string) string {
+	return fmt.Sprintf("%s:%s", IMAGE_JOB_PULLS_KEY, id)
+}
+
+// Splits an image into repository and tag ; tag defaults to latest
+func parseImageName(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	// a colon before the last slash is a registry port
+	if i == -1 || strings.Contains(image[i:], "/") {
+		return image, "latest"
+	}
+	return image[:i], image[i+1:]
+}
+
+// Returns all image jobs keyed by id
+func getImageJobs(pool *redis.Pool) (map[string]*ImageJob, error) {
+	jobs := make(map[string]*ImageJob)
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := getIndexedValues(conn, IMAGE_JOB_KEY, getImageJobKey)
+	if err != nil {
+		return jobs, err
+	}
+	for id, data := range values {
+		j := &ImageJob{}
+		if err := json.Unmarshal(data, j); err != nil {
+			log.Printf("Error parsing image job %s: %s", id, err)
+			continue
+		}
+		jobs[getImageJobId(j)] = j
+	}
+	return jobs, nil
+}
+
+// Returns the pull status of the image job for each node
+func getImageJobStatus(pool *redis.Pool, id string) (map[string]string, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	return redis.StringMap(conn.Do("HGETALL", getImageJobStatusKey(id)))
+}
+
+// Sets the pull status of the node ; the start of a pull is recorded so
+// stale pulls can be expired
+func setImageJobStatus(pool *redis.Pool, id string, node string, status string) {
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("HSET", getImageJobStatusKey(id), node, status)
+	if status == IMAGE_STATUS_PULLING {
+		conn.Send("HSET", getImageJobPullsKey(id), node, time.Now().Unix())
+	} else {
+		conn.Send("HDEL", getImageJobPullsKey(id), node)
+	}
+	conn.Do("EXEC")
+}
+
+// Marks pulls that have not finished within IMAGE_PULL_TIMEOUT as failed
+// (i.e. the node stopped while pulling)
+func expireImagePulls(pool *redis.Pool, jobs map[string]*ImageJob) {
+	conn := pool.Get()
+	defer conn.Close()
+	cutoff := time.Now().Unix() - IMAGE_PULL_TIMEOUT
+	for id := range jobs {
+		pulls, err := redis.Int64Map(conn.Do("HGETALL", getImageJobPullsKey(id)))
+		if err != nil {
+			continue
+		}
+		for node, started := range pulls {
+			if started >= cutoff {
+				continue
+			}
+			log.Printf("Image job %s: pull on node %s timed out", id, node)
+			conn.Send("MULTI")
+			conn.Send("HSET", getImageJobStatusKey(id), node, IMAGE_STATUS_FAILED)
+			conn.Send("HDEL", getImageJobPullsKey(id), node)
+			conn.Do("EXEC")
+		}
+	}
+}
+
+// Removes the pull status of a node that left the cluster
+func removeImageJobNode(pool *redis.Pool, nodeKey string) error {
+	jobs, err := getImageJobs(pool)
+	if err != nil {
+		return err
+	}
+	zone, name := parseNodeKey(nodeKey)
+	conn := pool.Get()
+	defer conn.Close()
+	for id, j := range jobs {
+		if j.Zone != "" && j.Zone != zone {
+			continue
+		}
+		conn.Send("HDEL", getImageJobStatusKey(id), name)
+		conn.Send("HDEL", getImageJobPullsKey(id), name)
+	}
+	_, err = conn.Do("")
+	return err
+}
+
+// Pulls images for pending image jobs in the node zone
+func (e *Engine) processImageJobs() {
+	jobs, err := getImageJobs(e.redisPool)
+	if err != nil {
+		log.Printf("Error getting image jobs: %s", err)
+		return
+	}
+	expireImagePulls(e.redisPool, jobs)
+	for id, j := range jobs {
+		if j.Zone != "" && j.Zone != e.Zone {
+			continue
+		}
+		status, err := getImageJobStatus(e.redisPool, id)
+		if err != nil {
+			continue
+		}
+		if s, ok := status[e.Name]; ok && s != IMAGE_STATUS_PENDING {
+			continue
+		}
+		setImageJobStatus(e.redisPool, id, e.Name, IMAGE_STATUS_PULLING)
+		log.Printf("Pulling image %s", j.Image)
+		if err := e.Docker.PullImage(j.Image); err != nil {
+			log.Printf("Error pulling image %s: %s", j.Image, err)
+			setImageJobStatus(e.redisPool, id, e.Name, IMAGE_STATUS_FAILED)
+			continue
+		}
+		log.Printf("Pulled image %s", j.Image)
+		setImageJobStatus(e.redisPool, id, e.Name, IMAGE_STATUS_DONE)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseImageName(t *testing.T) {
+	tests := map[string][2]string{
+		"busybox":                     {"busybox", "latest"},
+		"ubuntu:14.04":                {"ubuntu", "14.04"},
+		"registry:5000/app":           {"registry:5000/app", "latest"},
+		"registry:5000/app:v1":        {"registry:5000/app", "v1"},
+		"ehazlett/docker-hive:latest": {"ehazlett/docker-hive", "latest"},
+	}
+	for image, expected := range tests {
+		repo, tag := parseImageName(image)
+		if repo != expected[0] || tag != expected[1] {
+			t.Fatalf("Error: expected %v for %s ; received: %s %s", expected, image, repo, tag)
+		}
+	}
+}
+
+func TestGetImageJobId(t *testing.T) {
+	id := getImageJobId(&ImageJob{Image: "busybox:latest", Zone: "east"})
+	if id != "east:busybox:latest" {
+		t.Fatalf("Error: expected east:busybox:latest ; received: %s", id)
+	}
+}
+
+func TestExpireImagePulls(t *testing.T) {
+	s, _ := newTestScheduler(t)
+	id, err := s.AddImageJob(&ImageJob{Image: "busybox", Zone: "default"})
+	if err != nil {
+		t.Fatalf("Error adding image job: %s", err)
+	}
+	setImageJobStatus(s.RedisPool, id, "node1", IMAGE_STATUS_PULLING)
+	setImageJobStatus(s.RedisPool, id, "node2", IMAGE_STATUS_PULLING)
+	conn := s.RedisPool.Get()
+	conn.Do("HSET", getImageJobPullsKey(id), "node1", time.Now().Unix()-IMAGE_PULL_TIMEOUT-1)
+	conn.Close()
+	jobs, err := getImageJobs(s.RedisPool)
+	if err != nil {
+		t.Fatalf("Error getting image jobs: %s", err)
+	}
+	expireImagePulls(s.RedisPool, jobs)
+	status, err := s.ImageJobStatus(id)
+	if err != nil {
+		t.Fatalf("Error getting image job status: %s", err)
+	}
+	if status["node1"] != IMAGE_STATUS_FAILED || status["node2"] != IMAGE_STATUS_PULLING {
+		t.Fatalf("Error: expected stale pull failed ; received: %v", status)
+	}
+}
+
+func TestRemoveImageJobNode(t *testing.T) {
+	s, _ := newTestScheduler(t)
+	id, err := s.AddImageJob(&ImageJob{Image: "busybox", Zone: "default"})
+	if err != nil {
+		t.Fatalf("Error adding image job: %s", err)
+	}
+	setImageJobStatus(s.RedisPool, id, "node1", IMAGE_STATUS_PULLING)
+	setImageJobStatus(s.RedisPool, id, "node2", IMAGE_STATUS_DONE)
+	if err := removeImageJobNode(s.RedisPool, getNodeKey("node1", "default")); err != nil {
+		t.Fatalf("Error removing node status: %s", err)
+	}
+	status, err := s.ImageJobStatus(id)
+	if err != nil {
+		t.Fatalf("Error getting image job status: %s", err)
+	}
+	if _, ok := status["node1"]; ok || status["node2"] != IMAGE_STATUS_DONE {
+		t.Fatalf("Error: expected node1 status removed ; received: %v", status)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	ErrContainerNotFound = errors.New("No such container")
+)
+
+// Returns container index key
+func getContainerIndexKey(id string) string {
+	return fmt.Sprintf("%s:%s", CONTAINER_INDEX_KEY, id)
+}
+
+// Returns exec index key
+func getExecIndexKey(id string) string {
+	return fmt.Sprintf("%s:%s", EXEC_INDEX_KEY, id)
+}
+
+// Returns the values of the keys for the ids in the index set ; ids whose
+// key no longer exists are skipped
+func getIndexedValues(conn redis.Conn, index string, key func(id string) string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	ids, err := redis.Strings(conn.Do("SMEMBERS", index))
+	if err != nil || len(ids) == 0 {
+		return values, err
+	}
+	keys := []string{}
+	for _, id := range ids {
+		keys = append(keys, key(id))
+	}
+	data, err := redis.Values(conn.Do("MGET", redis.Args{}.AddFlat(keys)...))
+	if err != nil {
+		return values, err
+	}
+	for i, v := range data {
+		b, err := redis.Bytes(v, nil)
+		if err != nil {
+			continue
+		}
+		values[ids[i]] = b
+	}
+	return values, nil
+}
+
+// Returns the names of a container without the leading slash ; link
+// aliases (i.e. /web/db) are ignored
+func containerNames(c APIContainer) []string {
+	names := []string{}
+	for _, n := range c.Names {
+		n = strings.TrimPrefix(n, "/")
+		if n == "" || strings.Contains(n, "/") {
+			continue
+		}
+		names = append(names, n)
+	}
+	return names
+}
+
+// Returns true if the container is running
+func isContainerRunning(c APIContainer) bool {
+	return strings.HasPrefix(c.Status, "Up")
+}
+
+// Returns lost containers key for the node
+func getLostContainersKey(nodeKey string) string {
+	return fmt.Sprintf("%s:%s", LOST_CONTAINERS_KEY, nodeKey)
+}
+
+// Records a container that was replaced after its node was lost
+func addLostContainer(pool *redis.Pool, id string, nodeKey string) {
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("SADD", getLostContainersKey(nodeKey), id)
+	conn.Do("SREM", MANAGED_CONTAINERS_KEY, id)
+}
+
+// Removes local containers that were replaced while the node was
+// unreachable (i.e. partitioned)
+func (e *Engine) removeLostContainers() {
+	key := getLostContainersKey(getNodeKey(e.Name, e.Zone))
+	conn := e.redisPool.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("SMEMBERS", key))
+	if err != nil {
+		log.Printf("Error getting lost containers: %s", err)
+		return
+	}
+	for _, id := range ids {
+		if err := e.Docker.RemoveContainer(id); err != nil && err != ErrContainerNotFound {
+			log.Printf("Error removing lost container %s: %s", id, err)
+			continue
+		}
+		log.Printf("Removed lost container %s", id)
+		conn.Do("SREM", key, id)
+	}
+}
+
+// Publishes the ids and names of all local containers to the cluster index
+// along with the number of running hive managed containers
+func (e *Engine) indexContainers() {
+	e.removeLostContainers()
+	containers, err := e.Docker.ListContainers(true)
+	if err != nil {
+		log.Printf("Error listing local containers: %s", err)
+		return
+	}
+	nodeKey := getNodeKey(e.Name, e.Zone)
+	conn := e.redisPool.Get()
+	defer conn.Close()
+	running := 0
+	for _, c := range containers {
+		if isContainerRunning(c) {
+			conn.Send("SISMEMBER", MANAGED_CONTAINERS_KEY, c.Id)
+			running++
+		}
+	}
+	conn.Flush()
+	managed := 0
+	for i := 0; i < running; i++ {
+		if ok, _ := redis.Bool(conn.Receive()); ok {
+			managed++
+		}
+	}
+	conn.Send("HSET", CONTAINER_COUNT_KEY, nodeKey, managed)
+	e.lock.Lock()
+	e.containers = running
+	e.lock.Unlock()
+	for _, c := range containers {
+		keys := append([]string{c.Id}, containerNames(c)...)
+		for _, k := range keys {
+			conn.Send("SETEX", getContainerIndexKey(k), CONTAINER_INDEX_INTERVAL*3, nodeKey)
+		}
+	}
+	conn.Flush()
+}
+
+// Adds a container to the cluster index for the node
+func indexContainer(pool *redis.Pool, id string, nodeKey string) {
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("SETEX", getContainerIndexKey(id), CONTAINER_INDEX_INTERVAL*3, nodeKey)
+}
+
+// Records the node running an exec instance so later exec requests (i.e.
+// start and resize) reach the same node
+func indexExec(pool *redis.Pool, id string, nodeKey string) {
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("SETEX", getExecIndexKey(id), EXEC_INDEX_TTL, nodeKey)
+}
+
+// Returns the node running the exec instance
+func findExecNode(pool *redis.Pool, id string) (*Node, error) {
+	conn := pool.Get()
+	nodeKey, err := redis.String(conn.Do("GET", getExecIndexKey(id)))
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	return getNode(pool, nodeKey)
+}
+
+// Removes a container from the cluster index
+func unindexContainer(pool *redis.Pool, id string) {
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", getContainerIndexKey(id))
+	conn.Do("SREM", MANAGED_CONTAINERS_KEY, id)
+}
+
+// Marks a container as managed by the hive and counts it against the node
+func addManagedContainer(pool *redis.Pool, id string, nodeKey string) {
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("SADD", MANAGED_CONTAINERS_KEY, id)
+	conn.Do("HINCRBY", CONTAINER_COUNT_KEY, nodeKey, 1)
+}
+
+// Returns the number of running hive managed containers for each node key
+func getContainerCounts(pool *redis.Pool) (map[string]int, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	return redis.IntMap(conn.Do("HGETALL", CONTAINER_COUNT_KEY))
+}
+
+// Returns the node that owns the container ; id can be a container id,
+// short id or name
+func findContainerNode(pool *redis.Pool, id string, apiVersion string) (*Node, error) {
+	conn := pool.Get()
+	nodeKey, err := redis.String(conn.Do("GET", getContainerIndexKey(id)))
+	conn.Close()
+	if err == nil {
+		if n, err := getNode(pool, nodeKey); err == nil {
+			return n, nil
+		}
+	}
+	// not indexed (short id or recently created) ; ask every node
+	nodes, err := getNodes(pool, "")
+	if err != nil {
+		return nil, err
+	}
+	found := make(chan *Node, len(nodes))
+	path := fmt.Sprintf("/%s/containers/%s/json", apiVersion, id)
+	forEachNode(nodes, func(n *Node) {
+		resp, err := nodeRequest(n, "GET", path, nil)
+		if err != nil {
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			found <- n
+		}
+	})
+	close(found)
+	n, ok := <-found
+	if !ok {
+		return nil, ErrContainerNotFound
+	}
+	indexContainer(pool, id, getNodeKey(n.Name, n.Zone))
+	return n, nil
+}
@@ -0,0 +1,36 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"testing"
+)
+
+func TestGetContainerIndexKey(t *testing.T) {
+	testKey := "containers:abc123"
+	key := getContainerIndexKey("abc123")
+	if key != testKey {
+		t.Fatalf("Error: expected %s ; received: %s", testKey, key)
+	}
+}
+
+func TestContainerNamesIgnoresLinks(t *testing.T) {
+	c := APIContainer{Names: []string{"/db", "/web/db"}}
+	names := containerNames(c)
+	if len(names) != 1 || names[0] != "db" {
+		t.Fatalf("Error: expected [db] ; received: %v", names)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ehazlett/docker-hive/utils"
+	"github.com/garyburd/redigo/redis"
+)
+
+type (
+	MasterObserver interface {
+		MasterGained(term int64)
+		MasterLost(term int64)
+	}
+
+	// Error response from the master
+	MasterError struct {
+		StatusCode int
+		Message    string
+	}
+
+	// Runs periodically while the node is master
+	MasterTask struct {
+		Name     string
+		Interval time.Duration
+		Run      func(term int64)
+		stop     chan bool
+		wg       sync.WaitGroup
+	}
+)
+
+var (
+	ErrNoMaster = errors.New("No master elected")
+)
+
+// Returns the node record of the master
+func getMasterNode(pool *redis.Pool) (*Node, error) {
+	name, _, err := getMaster(pool)
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, ErrNoMaster
+	}
+	nodes, err := getNodes(pool, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if n.Name == name {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("Master node %s not found", name)
+}
+
+// Performs a request against the hive API of the master and decodes the
+// JSON response into v
+func masterRequest(pool *redis.Pool, method string, path string, v interface{}) error {
+	n, err := getMasterNode(pool)
+	if err != nil {
+		return err
+	}
+	// master operations (i.e. drains) run until complete
+	resp, err := doNodeRequest(utils.NodeStreamClient, n, method, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := new(bytes.Buffer)
+		msg.ReadFrom(resp.Body)
+		return &MasterError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(msg.String())}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (e *MasterError) Error() string {
+	return fmt.Sprintf("master returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// Adds an observer notified when the node gains or loses mastership
+func (e *Engine) AddMasterObserver(o MasterObserver) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.observers = append(e.observers, o)
+}
+
+// Notifies observers of a change in mastership
+func (e *Engine) notifyMasterChange(oldTerm int64, newTerm int64) {
+	e.lock.Lock()
+	observers := make([]MasterObserver, len(e.observers))
+	copy(observers, e.observers)
+	e.lock.Unlock()
+	for _, o := range observers {
+		if oldTerm > 0 {
+			o.MasterLost(oldTerm)
+		}
+		if newTerm > 0 {
+			o.MasterGained(newTerm)
+		}
+	}
+}
+
+func (t *MasterTask) MasterGained(term int64) {
+	t.MasterLost(term)
+	log.Printf("Starting master task: %s", t.Name)
+	t.stop = make(chan bool)
+	t.wg.Add(1)
+	go t.loop(term, t.stop)
+}
+
+func (t *MasterTask) MasterLost(term int64) {
+	if t.stop == nil {
+		return
+	}
+	log.Printf("Stopping master task: %s", t.Name)
+	close(t.stop)
+	t.wg.Wait()
+	t.stop = nil
+}
+
+func (t *MasterTask) loop(term int64, stop chan bool) {
+	defer t.wg.Done()
+	tick := time.NewTicker(t.Interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.Run(term)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Removes nodes that have missed heartbeats beyond the grace period and
+// reschedules their job instances
+func (e *Engine) reapNodes(term int64) {
+	if !isMasterTerm(e.redisPool, e.Name, term) {
+		return
+	}
+	dead, err := getDeadNodes(e.redisPool)
+	if err != nil {
+		log.Printf("Error getting dead nodes: %s", err)
+		return
+	}
+	for _, nodeKey := range dead {
+		lost, err := e.Scheduler.NodeLost(nodeKey, term)
+		if err != nil {
+			log.Printf("Error marking instances lost for node %s: %s", nodeKey, err)
+			continue
+		}
+		if err := fencedRemoveNode(e.redisPool, e.Name, term, nodeKey); err != nil {
+			log.Printf("Error removing node %s: %s", nodeKey, err)
+			continue
+		}
+		if err := removeImageJobNode(e.redisPool, nodeKey); err != nil {
+			log.Printf("Error removing image job status for node %s: %s", nodeKey, err)
+		}
+		log.Printf("Reaped node %s ; %d job instance(s) lost", nodeKey, lost)
+	}
+	counts, err := getContainerCounts(e.redisPool)
+	if err != nil {
+		log.Printf("Error getting container counts: %s", err)
+		return
+	}
+	for nodeKey := range counts {
+		if _, err := getNode(e.redisPool, nodeKey); err == nil || isNodeWithinGrace(e.redisPool, nodeKey) {
+			continue
+		}
+		if err := fencedHDel(e.redisPool, e.Name, term, CONTAINER_COUNT_KEY, nodeKey); err != nil {
+			log.Printf("Error removing container count for node %s: %s", nodeKey, err)
+			return
+		}
+	}
+	if len(dead) > 0 {
+		// replace lost instances without waiting for the next interval
+		e.reconcileJobs(term)
+	}
+}
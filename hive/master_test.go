@@ -0,0 +1,153 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type testObserver struct {
+	sync.Mutex
+	events []string
+}
+
+func (o *testObserver) MasterGained(term int64) {
+	o.Lock()
+	defer o.Unlock()
+	o.events = append(o.events, "gained")
+}
+
+func (o *testObserver) MasterLost(term int64) {
+	o.Lock()
+	defer o.Unlock()
+	o.events = append(o.events, "lost")
+}
+
+func TestNotifyMasterChange(t *testing.T) {
+	e := &Engine{}
+	o := &testObserver{}
+	e.AddMasterObserver(o)
+	e.notifyMasterChange(0, 1)
+	e.notifyMasterChange(1, 2)
+	e.notifyMasterChange(2, 0)
+	expected := []string{"gained", "lost", "gained", "lost"}
+	if len(o.events) != len(expected) {
+		t.Fatalf("Error: expected %v ; received: %v", expected, o.events)
+	}
+	for i, ev := range expected {
+		if o.events[i] != ev {
+			t.Fatalf("Error: expected %v ; received: %v", expected, o.events)
+		}
+	}
+}
+
+func TestMasterTaskStopsWhenLost(t *testing.T) {
+	var lock sync.Mutex
+	runs := 0
+	task := &MasterTask{
+		Name:     "test",
+		Interval: time.Millisecond,
+		Run: func(term int64) {
+			lock.Lock()
+			runs++
+			lock.Unlock()
+		},
+	}
+	task.MasterGained(1)
+	time.Sleep(20 * time.Millisecond)
+	task.MasterLost(1)
+	lock.Lock()
+	stopped := runs
+	lock.Unlock()
+	if stopped == 0 {
+		t.Fatalf("Error: expected task to run")
+	}
+	time.Sleep(10 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if runs != stopped {
+		t.Fatalf("Error: expected task to stop ; ran %d more times", runs-stopped)
+	}
+}
+
+func TestReapNodesReplacesLostInstances(t *testing.T) {
+	s, term := newTestScheduler(t)
+	dead := newFakeNode(t, s.RedisPool, "node1", "default")
+	live := newFakeNode(t, s.RedisPool, "node2", "default")
+	addTestJob(t, s, term, dead, 1)
+	setTestHeartbeat(t, s.RedisPool, "node1", "default", time.Now().Add(-(NODE_DEAD_GRACE+5)*time.Second))
+
+	e := &Engine{Name: "master", Zone: "default", Master: true, term: term, Scheduler: s, redisPool: s.RedisPool}
+	e.reapNodes(term)
+	instances, err := s.getJobInstances("web")
+	if err != nil {
+		t.Fatalf("Error getting job instances: %s", err)
+	}
+	containers := live.Containers()
+	if len(instances) != 1 || len(containers) != 1 || instances[containers[0]] != getNodeKey("node2", "default") {
+		t.Fatalf("Error: expected instance replaced on node2 ; received: %v", instances)
+	}
+	if nodes, _ := getNodes(s.RedisPool, "default"); len(nodes) != 1 || nodes[0].Name != "node2" {
+		t.Fatalf("Error: expected node1 reaped ; received: %v", nodes)
+	}
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	lost, err := redis.Strings(conn.Do("SMEMBERS", getLostContainersKey(getNodeKey("node1", "default"))))
+	if err != nil || len(lost) != 1 || lost[0] != "node1-web" {
+		t.Fatalf("Error: expected node1-web lost ; received: %v %v", lost, err)
+	}
+	if len(dead.Removed()) != 0 {
+		t.Fatalf("Error: expected no requests to the dead node ; received: %v", dead.Removed())
+	}
+}
+
+func TestRemoveLostContainers(t *testing.T) {
+	pool := newTestPool(t)
+	removed := []string{}
+	var lock sync.Mutex
+	m := http.NewServeMux()
+	m.HandleFunc("/containers/", func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "POST":
+			w.WriteHeader(http.StatusNoContent)
+		case req.Method == "DELETE" && req.URL.Path == "/containers/gone":
+			http.NotFound(w, req)
+		case req.Method == "DELETE":
+			lock.Lock()
+			removed = append(removed, req.URL.Path)
+			lock.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	e := &Engine{Name: "node1", Zone: "default", redisPool: pool, Docker: newTestEngineClient(t, m)}
+	nodeKey := getNodeKey("node1", "default")
+	addLostContainer(pool, "web", nodeKey)
+	addLostContainer(pool, "gone", nodeKey)
+	e.removeLostContainers()
+	if len(removed) != 1 || removed[0] != "/containers/web" {
+		t.Fatalf("Error: expected web removed ; received: %v", removed)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if n, err := redis.Int(conn.Do("SCARD", getLostContainersKey(nodeKey))); err != nil || n != 0 {
+		t.Fatalf("Error: expected no lost containers ; received: %d %v", n, err)
+	}
+}
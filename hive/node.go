@@ -0,0 +1,273 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ehazlett/docker-hive/utils"
+	"github.com/garyburd/redigo/redis"
+)
+
+type (
+	Node struct {
+		Name          string
+		Zone          string
+		Address       string
+		Version       string
+		DockerVersion string
+		StartedAt     time.Time
+		LastHeartbeat time.Time
+		Master        bool
+		Containers    int
+		Cordoned      bool
+	}
+
+	NodeInfo struct {
+		*Node
+		Uptime string
+	}
+
+	nodesByName []*Node
+)
+
+func (n nodesByName) Len() int { return len(n) }
+func (n nodesByName) Less(i, j int) bool {
+	if n[i].Zone != n[j].Zone {
+		return n[i].Zone < n[j].Zone
+	}
+	return n[i].Name < n[j].Name
+}
+func (n nodesByName) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+
+// Decodes a node record ; older nodes publish only the connection string
+func parseNode(key string, data string) *Node {
+	n := &Node{}
+	if err := json.Unmarshal([]byte(data), n); err != nil {
+		n.Address = data
+	}
+	n.Zone, n.Name = parseNodeKey(key)
+	return n
+}
+
+// Returns the zone and node name from a node key
+func parseNodeKey(key string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(key, NODE_KEY+":"), ":", 2)
+	if len(parts) != 2 {
+		return "", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// Returns zone index key
+func getZoneKey(zone string) string {
+	return fmt.Sprintf("%s:%s", ZONE_KEY, zone)
+}
+
+// Adds the node to the zone index scored by the heartbeat time
+func indexNode(conn redis.Conn, name string, zone string, heartbeat time.Time) {
+	conn.Send("SADD", ZONE_KEY, zone)
+	conn.Send("ZADD", getZoneKey(zone), heartbeat.Unix(), name)
+}
+
+// Returns the names of the live nodes in the zone
+func getZoneNodeNames(conn redis.Conn, zone string) ([]string, error) {
+	cutoff := time.Now().Unix() - NODE_TTL
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", getZoneKey(zone), cutoff, "+inf"))
+}
+
+// Returns the keys of nodes that have missed heartbeats for longer than
+// the grace period
+func getDeadNodes(pool *redis.Pool) ([]string, error) {
+	dead := []string{}
+	conn := pool.Get()
+	defer conn.Close()
+	zones, err := redis.Strings(conn.Do("SMEMBERS", ZONE_KEY))
+	if err != nil {
+		return dead, err
+	}
+	cutoff := time.Now().Unix() - NODE_DEAD_GRACE
+	for _, z := range zones {
+		names, err := redis.Strings(conn.Do("ZRANGEBYSCORE", getZoneKey(z), "-inf", fmt.Sprintf("(%d", cutoff)))
+		if err != nil {
+			return dead, err
+		}
+		for _, name := range names {
+			dead = append(dead, getNodeKey(name, z))
+		}
+	}
+	return dead, nil
+}
+
+// Returns true if the node has sent a heartbeat within the grace period
+func isNodeWithinGrace(pool *redis.Pool, nodeKey string) bool {
+	conn := pool.Get()
+	defer conn.Close()
+	zone, name := parseNodeKey(nodeKey)
+	heartbeat, err := redis.Int64(conn.Do("ZSCORE", getZoneKey(zone), name))
+	if err != nil {
+		return false
+	}
+	return heartbeat >= time.Now().Unix()-NODE_DEAD_GRACE
+}
+
+// Removes the node from the zone index and the zone if it is empty
+func removeNode(conn redis.Conn, nodeKey string) {
+	zone, name := parseNodeKey(nodeKey)
+	key := getZoneKey(zone)
+	conn.Do("ZREM", key, name)
+	if n, err := redis.Int(conn.Do("ZCARD", key)); err == nil && n == 0 {
+		conn.Do("SREM", ZONE_KEY, zone)
+	}
+}
+
+// Returns all live nodes in the zone ; all zones if zone is empty
+func getNodes(pool *redis.Pool, zone string) ([]*Node, error) {
+	nodes := []*Node{}
+	conn := pool.Get()
+	defer conn.Close()
+	zones := []string{zone}
+	if zone == "" {
+		z, err := redis.Strings(conn.Do("SMEMBERS", ZONE_KEY))
+		if err != nil {
+			return nodes, err
+		}
+		zones = z
+	}
+	for _, z := range zones {
+		names, err := getZoneNodeNames(conn, z)
+		if err != nil {
+			return nodes, err
+		}
+		if len(names) == 0 {
+			continue
+		}
+		keys := []string{}
+		for _, name := range names {
+			keys = append(keys, getNodeKey(name, z))
+		}
+		values, err := redis.Values(conn.Do("MGET", redis.Args{}.AddFlat(keys)...))
+		if err != nil {
+			return nodes, err
+		}
+		for i, v := range values {
+			data, err := redis.String(v, nil)
+			if err != nil {
+				// node record expired
+				continue
+			}
+			nodes = append(nodes, parseNode(keys[i], data))
+		}
+	}
+	return nodes, nil
+}
+
+// Returns the live node for the node key
+func getNode(pool *redis.Pool, key string) (*Node, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	data, err := redis.String(conn.Do("GET", key))
+	if err != nil {
+		return nil, err
+	}
+	return parseNode(key, data), nil
+}
+
+// Returns the node record for the local engine
+func (e *Engine) nodeRecord() *Node {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return &Node{
+		Name:          e.Name,
+		Zone:          e.Zone,
+		Address:       e.ConnectionString(),
+		Version:       e.Version,
+		DockerVersion: e.dockerVer,
+		StartedAt:     e.startedAt,
+		LastHeartbeat: time.Now(),
+		Master:        e.Master,
+		Containers:    e.containers,
+	}
+}
+
+// Updates the Docker version reported in the node record
+func (e *Engine) updateDockerVersion() {
+	v, err := e.Docker.Version()
+	if err != nil {
+		log.Printf("Error getting Docker version: %s", err)
+		return
+	}
+	e.lock.Lock()
+	e.dockerVer = v
+	e.lock.Unlock()
+}
+
+// Runs fn against each node concurrently and waits for all to finish
+func forEachNode(nodes []*Node, fn func(n *Node)) {
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			fn(n)
+		}(n)
+	}
+	wg.Wait()
+}
+
+// Performs a request against the local Docker API of a node ; the request
+// fails if the node does not respond within NODE_RESPONSE_TIMEOUT
+func nodeRequest(n *Node, method string, path string, body io.Reader) (*http.Response, error) {
+	return doNodeRequest(utils.NodeClient, n, method, path, body)
+}
+
+func doNodeRequest(client *http.Client, n *Node, method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s%s", n.Address, path), body)
+	if err != nil {
+		return nil, err
+	}
+	// prevent the node from aggregating the request across the cluster
+	req.Header.Set(HIVE_LOCAL_HEADER, "true")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return client.Do(req)
+}
+
+// Performs a GET against a node and decodes the JSON response into v
+func getNodeJSON(n *Node, path string, v interface{}) error {
+	resp, err := nodeRequest(n, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node %s returned status %d", n.Name, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Returns true if the request should only be handled by the local node
+func isLocalRequest(req *http.Request) bool {
+	return req.Header.Get(HIVE_LOCAL_HEADER) != ""
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestParseNodeKey(t *testing.T) {
+	zone, name := parseNodeKey(getNodeKey("foo", "testZone"))
+	if zone != "testZone" {
+		t.Fatalf("Error: expected zone testZone ; received: %s", zone)
+	}
+	if name != "foo" {
+		t.Fatalf("Error: expected name foo ; received: %s", name)
+	}
+}
+
+func TestIsLocalRequest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/v1.10/containers/json", nil)
+	if isLocalRequest(req) {
+		t.Fatalf("Error: expected request to not be local")
+	}
+	req.Header.Set(HIVE_LOCAL_HEADER, "true")
+	if !isLocalRequest(req) {
+		t.Fatalf("Error: expected request to be local")
+	}
+}
+
+func TestParseNode(t *testing.T) {
+	key := getNodeKey("foo", "testZone")
+	n := parseNode(key, `{"Address": "http://10.0.0.1:4500", "Version": "0.3.0"}`)
+	if n.Address != "http://10.0.0.1:4500" || n.Version != "0.3.0" {
+		t.Fatalf("Error: unexpected node record: %+v", n)
+	}
+	if n.Name != "foo" || n.Zone != "testZone" {
+		t.Fatalf("Error: expected node foo in testZone ; received: %s in %s", n.Name, n.Zone)
+	}
+	// older nodes publish only the connection string
+	n = parseNode(key, "http://10.0.0.1:4500")
+	if n.Address != "http://10.0.0.1:4500" {
+		t.Fatalf("Error: expected address http://10.0.0.1:4500 ; received: %s", n.Address)
+	}
+}
+
+func TestGetZoneKey(t *testing.T) {
+	testKey := "zones:testZone"
+	key := getZoneKey("testZone")
+	if key != testKey {
+		t.Fatalf("Error: expected %s ; received: %s", testKey, key)
+	}
+}
+
+// Sets the last heartbeat of a node in the zone index
+func setTestHeartbeat(t *testing.T, pool *redis.Pool, name string, zone string, heartbeat time.Time) {
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("ZADD", getZoneKey(zone), heartbeat.Unix(), name); err != nil {
+		t.Fatalf("Error setting heartbeat: %s", err)
+	}
+}
+
+func TestGetDeadNodes(t *testing.T) {
+	pool := newTestPool(t)
+	registerTestNode(t, pool, "live", "default", "http://127.0.0.1:1")
+	registerTestNode(t, pool, "late", "default", "http://127.0.0.1:1")
+	registerTestNode(t, pool, "dead", "default", "http://127.0.0.1:1")
+	setTestHeartbeat(t, pool, "late", "default", time.Now().Add(-(NODE_DEAD_GRACE-5)*time.Second))
+	setTestHeartbeat(t, pool, "dead", "default", time.Now().Add(-(NODE_DEAD_GRACE+5)*time.Second))
+	dead, err := getDeadNodes(pool)
+	if err != nil {
+		t.Fatalf("Error getting dead nodes: %s", err)
+	}
+	if len(dead) != 1 || dead[0] != getNodeKey("dead", "default") {
+		t.Fatalf("Error: expected dead node ; received: %v", dead)
+	}
+	if !isNodeWithinGrace(pool, getNodeKey("late", "default")) {
+		t.Fatalf("Error: expected late node within the grace period")
+	}
+	if isNodeWithinGrace(pool, getNodeKey("dead", "default")) {
+		t.Fatalf("Error: expected dead node outside the grace period")
+	}
+	if isNodeWithinGrace(pool, getNodeKey("unknown", "default")) {
+		t.Fatalf("Error: expected unknown node outside the grace period")
+	}
+}
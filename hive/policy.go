@@ -18,8 +18,11 @@ package hive
 import (
 	"errors"
 	"fmt"
+	"log"
 	"math/rand"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -27,7 +30,7 @@ import (
 type (
 	RunPolicy interface {
 		Name() string
-		GetNodes(int64, string) ([]string, error)
+		GetNodes(*ContainerConfig) ([]string, error)
 	}
 
 	RandomPolicy struct {
@@ -37,67 +40,215 @@ type (
 	UniquePolicy struct {
 		RedisPool *redis.Pool
 	}
+
+	BinpackPolicy struct {
+		RedisPool *redis.Pool
+	}
+
+	SpreadPolicy struct {
+		RedisPool *redis.Pool
+	}
 )
 
-func allNodes(pool *redis.Pool) ([]string, error) {
+// Random Policy
+func (p *RandomPolicy) Name() string {
+	return "random"
+}
+
+func (p *RandomPolicy) GetNodes(config *ContainerConfig) ([]string, error) {
 	nodes := []string{}
-	conn := pool.Get()
-	keys, err := redis.Strings(conn.Do("KEYS", fmt.Sprintf("%s:*", NODE_KEY)))
+	candidates, err := candidateNodes(p.RedisPool, config)
 	if err != nil {
 		return nodes, err
 	}
-	for _, k := range keys {
-		n := strings.Split(k, ":")
-		nodes = append(nodes, n[2])
+	zoneNodes := nodeNames(candidates)
+	numNodes := len(zoneNodes)
+	if numNodes == 0 {
+		return nodes, errors.New("No nodes found in that zone")
+	}
+	// get as many as requested
+	for i := 0; i < int(config.NumberOfInstances); i++ {
+		r := rand.Intn(numNodes)
+		nodes = append(nodes, zoneNodes[r])
 	}
 	return nodes, nil
 }
 
-func getNodesByZone(pool *redis.Pool, zone string) ([]string, error) {
+// Unique Policy
+func (p *UniquePolicy) Name() string {
+	return "unique"
+}
+
+// Returns true if the container name is the name or an instance of it
+// (i.e. web or web-2 for web)
+func isInstanceName(name string, base string) bool {
+	if name == base {
+		return true
+	}
+	n := strings.TrimPrefix(name, base+"-")
+	if n == name || n == "" {
+		return false
+	}
+	_, err := strconv.Atoi(n)
+	return err == nil
+}
+
+// Returns true if the node is running a container with the same image or name
+func isRunningContainer(n *Node, config *ContainerConfig) (bool, error) {
+	containers := []APIContainer{}
+	path := fmt.Sprintf("/%s/containers/json", DOCKER_API_VERSION)
+	if err := getNodeJSON(n, path, &containers); err != nil {
+		return false, err
+	}
+	for _, c := range containers {
+		if config.Image != "" && (c.Image == config.Image || c.Image == config.Image+":latest") {
+			return true, nil
+		}
+		if config.Name == "" {
+			continue
+		}
+		for _, name := range containerNames(c) {
+			if isInstanceName(name, config.Name) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (p *UniquePolicy) GetNodes(config *ContainerConfig) ([]string, error) {
 	nodes := []string{}
-	conn := pool.Get()
-	keys, err := redis.Strings(conn.Do("KEYS", fmt.Sprintf("%s:%s:*", NODE_KEY, zone)))
+	zoneNodes, err := candidateNodes(p.RedisPool, config)
 	if err != nil {
 		return nodes, err
 	}
-	for _, k := range keys {
-		n := strings.Replace(k, fmt.Sprintf("%s:%s:", NODE_KEY, zone), "", 1)
-		nodes = append(nodes, n)
+	num := int(config.NumberOfInstances)
+	if len(zoneNodes) < num {
+		return nodes, fmt.Errorf("Zone %s has %d eligible nodes ; %d requested", config.Zone, len(zoneNodes), num)
+	}
+	// prefer nodes that are not running the container ; nodes that cannot
+	// be checked are skipped
+	free := []string{}
+	running := []string{}
+	var lock sync.Mutex
+	forEachNode(zoneNodes, func(n *Node) {
+		r, err := isRunningContainer(n, config)
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case err != nil:
+			log.Printf("Error checking containers on node %s: %s", n.Name, err)
+		case r:
+			running = append(running, n.Name)
+		default:
+			free = append(free, n.Name)
+		}
+	})
+	if len(free)+len(running) < num {
+		return nodes, fmt.Errorf("Zone %s has %d reachable nodes ; %d requested", config.Zone, len(free)+len(running), num)
+	}
+	for _, i := range rand.Perm(len(free)) {
+		nodes = append(nodes, free[i])
+	}
+	for _, i := range rand.Perm(len(running)) {
+		nodes = append(nodes, running[i])
+	}
+	return nodes[:num], nil
+}
+
+// Binpack Policy
+func (p *BinpackPolicy) Name() string {
+	return "binpack"
+}
+
+func (p *BinpackPolicy) GetNodes(config *ContainerConfig) ([]string, error) {
+	nodes := []string{}
+	candidates, err := candidateNodes(p.RedisPool, config)
+	if err != nil {
+		return nodes, err
+	}
+	zoneNodes := nodeNames(candidates)
+	resources := make(map[string]*NodeResources)
+	for _, n := range zoneNodes {
+		res, err := getNodeResources(p.RedisPool, n, config.Zone)
+		if err != nil {
+			continue
+		}
+		resources[n] = res
+	}
+	if len(resources) == 0 {
+		return nodes, errors.New("No nodes with resources found in that zone")
+	}
+	for i := 0; i < int(config.NumberOfInstances); i++ {
+		node := binpackNode(resources, config)
+		if node == "" {
+			return nodes, fmt.Errorf("Not enough resources in zone %s for %d instances", config.Zone, config.NumberOfInstances)
+		}
+		resources[node].Allocate(config)
+		nodes = append(nodes, node)
 	}
 	return nodes, nil
+}
 
+// Returns the most allocated node that still fits the container
+func binpackNode(resources map[string]*NodeResources, config *ContainerConfig) string {
+	node := ""
+	usage := -1.0
+	for n, res := range resources {
+		if !res.Fits(config) {
+			continue
+		}
+		u := res.Usage()
+		// break ties by name so placement is deterministic
+		if u > usage || (u == usage && n < node) {
+			node = n
+			usage = u
+		}
+	}
+	return node
 }
 
-// Random Policy
-func (p *RandomPolicy) Name() string {
-	return "random"
+// Spread Policy
+func (p *SpreadPolicy) Name() string {
+	return "spread"
 }
 
-func (p *RandomPolicy) GetNodes(num int64, zone string) ([]string, error) {
-	// TODO: return multiple nodes based upon random
+func (p *SpreadPolicy) GetNodes(config *ContainerConfig) ([]string, error) {
 	nodes := []string{}
-	zoneNodes, err := getNodesByZone(p.RedisPool, zone)
+	candidates, err := candidateNodes(p.RedisPool, config)
 	if err != nil {
 		return nodes, err
 	}
-	numNodes := len(zoneNodes)
-	if numNodes == 0 {
+	zoneNodes := nodeNames(candidates)
+	if len(zoneNodes) == 0 {
 		return nodes, errors.New("No nodes found in that zone")
 	}
-	// get as many as requested
-	for i := 0; i < int(num); i++ {
-		r := rand.Intn(numNodes)
-		nodes = append(nodes, zoneNodes[r])
+	counts, err := getContainerCounts(p.RedisPool)
+	if err != nil {
+		return nodes, err
+	}
+	zoneCounts := make(map[string]int)
+	for _, n := range zoneNodes {
+		zoneCounts[n] = counts[getNodeKey(n, config.Zone)]
+	}
+	for i := 0; i < int(config.NumberOfInstances); i++ {
+		node := spreadNode(zoneCounts)
+		zoneCounts[node]++
+		nodes = append(nodes, node)
 	}
 	return nodes, nil
 }
 
-// Unique Policy
-func (p *UniquePolicy) Name() string {
-	return "unique"
-}
-
-func (p *UniquePolicy) GetNodes(num int64, zone string) ([]string, error) {
-	// TODO: return unique nodes based upon criteria
-	return []string{}, nil
+// Returns the node with the fewest containers
+func spreadNode(counts map[string]int) string {
+	node := ""
+	min := -1
+	for n, c := range counts {
+		// break ties by name so placement is deterministic
+		if min == -1 || c < min || (c == min && n < node) {
+			node = n
+			min = c
+		}
+	}
+	return node
 }
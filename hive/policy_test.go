@@ -0,0 +1,109 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBinpackNodeSelectsFullestNode(t *testing.T) {
+	resources := map[string]*NodeResources{
+		"empty": {TotalMemory: 1000, TotalCpuShares: 2048},
+		"half":  {TotalMemory: 1000, AllocatedMemory: 500, TotalCpuShares: 2048, AllocatedCpuShares: 1024},
+		"full":  {TotalMemory: 1000, AllocatedMemory: 950, TotalCpuShares: 2048, AllocatedCpuShares: 2048},
+	}
+	config := &ContainerConfig{Memory: 100, CpuShares: 512}
+	node := binpackNode(resources, config)
+	if node != "half" {
+		t.Fatalf("Error: expected node half ; received: %s", node)
+	}
+}
+
+func TestBinpackNodeNoFit(t *testing.T) {
+	resources := map[string]*NodeResources{
+		"small": {TotalMemory: 100, TotalCpuShares: 1024},
+	}
+	config := &ContainerConfig{Memory: 1000}
+	if node := binpackNode(resources, config); node != "" {
+		t.Fatalf("Error: expected no node ; received: %s", node)
+	}
+}
+
+func TestSpreadNodeSelectsLeastLoadedNode(t *testing.T) {
+	counts := map[string]int{
+		"node1": 3,
+		"node2": 1,
+		"node3": 2,
+	}
+	nodes := []string{}
+	for i := 0; i < 3; i++ {
+		n := spreadNode(counts)
+		counts[n]++
+		nodes = append(nodes, n)
+	}
+	expected := []string{"node2", "node2", "node3"}
+	for i, n := range nodes {
+		if n != expected[i] {
+			t.Fatalf("Error: expected %v ; received: %v", expected, nodes)
+		}
+	}
+	if n := spreadNode(counts); n != "node1" {
+		t.Fatalf("Error: expected node1 ; received: %s", n)
+	}
+}
+
+func TestIsInstanceName(t *testing.T) {
+	tests := map[string]bool{
+		"web":     true,
+		"web-2":   true,
+		"web-10":  true,
+		"webapp":  false,
+		"web-":    false,
+		"web-db":  false,
+		"web-db1": false,
+		"db":      false,
+	}
+	for name, expected := range tests {
+		if isInstanceName(name, "web") != expected {
+			t.Fatalf("Error: expected instance %v for %s", expected, name)
+		}
+	}
+}
+
+func TestUniquePolicyGetNodes(t *testing.T) {
+	pool := newTestPool(t)
+	node1 := newFakeNode(t, pool, "node1", "default")
+	node1.AddContainer("web-2", &ContainerConfig{Name: "web"}, true)
+	node2 := newFakeNode(t, pool, "node2", "default")
+	node2.AddContainer("webapp", &ContainerConfig{Name: "webapp"}, true)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	registerTestNode(t, pool, "node3", "default", down.URL)
+
+	p := &UniquePolicy{RedisPool: pool}
+	nodes, err := p.GetNodes(&ContainerConfig{Name: "web", Zone: "default", NumberOfInstances: 2})
+	if err != nil {
+		t.Fatalf("Error getting nodes: %s", err)
+	}
+	if len(nodes) != 2 || nodes[0] != "node2" || nodes[1] != "node1" {
+		t.Fatalf("Error: expected [node2 node1] ; received: %v", nodes)
+	}
+	if _, err := p.GetNodes(&ContainerConfig{Name: "web", Zone: "default", NumberOfInstances: 3}); err == nil {
+		t.Fatalf("Error: expected error with an unreachable node")
+	}
+}
@@ -0,0 +1,165 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+type (
+	NodeResources struct {
+		TotalMemory        int64
+		AllocatedMemory    int64
+		TotalCpuShares     int64
+		AllocatedCpuShares int64
+	}
+
+	DockerInfo struct {
+		Containers int
+		Images     int
+		MemTotal   int64
+		NCPU       int
+	}
+)
+
+// Returns node resources key
+func getResourcesKey(node string, zone string) string {
+	return fmt.Sprintf("%s:%s:%s", RESOURCES_KEY, zone, node)
+}
+
+// Returns true if the container fits in the remaining node resources
+func (r *NodeResources) Fits(config *ContainerConfig) bool {
+	return r.TotalMemory-r.AllocatedMemory >= config.Memory &&
+		r.TotalCpuShares-r.AllocatedCpuShares >= containerCpuShares(config)
+}
+
+// Returns the fraction of node resources allocated
+func (r *NodeResources) Usage() float64 {
+	usage := 0.0
+	if r.TotalMemory > 0 {
+		usage += float64(r.AllocatedMemory) / float64(r.TotalMemory)
+	}
+	if r.TotalCpuShares > 0 {
+		usage += float64(r.AllocatedCpuShares) / float64(r.TotalCpuShares)
+	}
+	return usage / 2
+}
+
+// Adds the container to the allocated node resources
+func (r *NodeResources) Allocate(config *ContainerConfig) {
+	r.AllocatedMemory += config.Memory
+	r.AllocatedCpuShares += containerCpuShares(config)
+}
+
+// Returns the cpu shares reserved by a container ; unset shares are only
+// relative weights so nothing is reserved
+func containerCpuShares(config *ContainerConfig) int64 {
+	if config.CpuShares <= 0 {
+		return 0
+	}
+	return config.CpuShares
+}
+
+// Returns the host memory in bytes from /proc/meminfo
+func hostMemory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var kb int64
+		if n, _ := fmt.Sscanf(s.Text(), "MemTotal: %d kB", &kb); n == 1 {
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// Calculates total and allocated resources for the local Docker host
+func (e *Engine) updateResources() {
+	info, err := e.Docker.Info()
+	if err != nil {
+		log.Printf("Error getting Docker info: %s", err)
+		info = &DockerInfo{}
+	}
+	if info.MemTotal == 0 {
+		info.MemTotal = hostMemory()
+	}
+	if info.NCPU == 0 {
+		info.NCPU = runtime.NumCPU()
+	}
+	res := &NodeResources{
+		TotalMemory:    info.MemTotal,
+		TotalCpuShares: int64(info.NCPU) * CPU_SHARES_PER_CPU,
+	}
+	containers, err := e.Docker.ListContainers(false)
+	if err != nil {
+		log.Printf("Error listing local containers: %s", err)
+		return
+	}
+	for _, c := range containers {
+		if !isContainerRunning(c) {
+			continue
+		}
+		container, err := e.Docker.InspectContainer(c.Id)
+		if err != nil {
+			continue
+		}
+		res.Allocate(&container.Config)
+	}
+	e.lock.Lock()
+	e.resources = res
+	e.lock.Unlock()
+}
+
+// Publishes the node resources
+func (e *Engine) publishResources(conn redis.Conn) {
+	e.lock.Lock()
+	res := e.resources
+	e.lock.Unlock()
+	if res == nil {
+		return
+	}
+	key := getResourcesKey(e.Name, e.Zone)
+	conn.Do("HMSET", redis.Args{}.Add(key).AddFlat(res)...)
+	conn.Do("EXPIRE", key, NODE_TTL)
+}
+
+// Returns the published resources for the node
+func getNodeResources(pool *redis.Pool, node string, zone string) (*NodeResources, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	v, err := redis.Values(conn.Do("HGETALL", getResourcesKey(node, zone)))
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 {
+		return nil, fmt.Errorf("No resources published for node %s", node)
+	}
+	res := &NodeResources{}
+	if err := redis.ScanStruct(v, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,38 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"testing"
+)
+
+func TestFitsUnsetCpuShares(t *testing.T) {
+	r := &NodeResources{
+		TotalMemory:        1024,
+		TotalCpuShares:     CPU_SHARES_PER_CPU,
+		AllocatedCpuShares: CPU_SHARES_PER_CPU,
+	}
+	if !r.Fits(&ContainerConfig{Memory: 512}) {
+		t.Fatalf("Error: expected container without cpu shares to fit")
+	}
+	if r.Fits(&ContainerConfig{Memory: 512, CpuShares: 512}) {
+		t.Fatalf("Error: expected container with cpu shares not to fit")
+	}
+	r.Allocate(&ContainerConfig{Memory: 512})
+	if r.AllocatedCpuShares != CPU_SHARES_PER_CPU {
+		t.Fatalf("Error: expected %d allocated cpu shares ; received: %d", CPU_SHARES_PER_CPU, r.AllocatedCpuShares)
+	}
+}
@@ -18,16 +18,38 @@ package hive
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
 type (
 	ContainerJob struct {
-		Config *ContainerConfig
-		Zone   string
+		Config     *ContainerConfig
+		HostConfig *HostConfig
+		Zone       string
+	}
+	InstanceResult struct {
+		Container string
+		Node      string
+		Zone      string
+		Removed   bool
+		Error     string
+	}
+	JobInstance struct {
+		Job       string
+		Container string
+		Node      string
+		Zone      string
+		State     string
+		Created   time.Time
+		Updated   time.Time
+		History   []*JobEvent `json:",omitempty"`
 	}
 	ImageJob struct {
 		Image string
@@ -35,37 +57,613 @@ type (
 	}
 	Scheduler interface {
 		AddContainerJob(j *ContainerJob) (string, error)
-		RemoveContainerJob(id string) (bool, error)
-		AddImageJob(j *ImageJob) (bool, error)
+		RemoveContainerJob(id string, term int64) ([]*InstanceResult, error)
+		ListContainerJobs() ([]*ContainerJob, error)
+		GetContainerJob(id string) (*ContainerJob, error)
+		ContainerJobInstances(id string) ([]*JobInstance, error)
+		ContainerJobHistory(id string) ([]*JobInstance, error)
+		AddImageJob(j *ImageJob) (string, error)
 		RemoveImageJob(id string) (bool, error)
+		ListImageJobs() (map[string]*ImageJob, error)
+		GetImageJob(id string) (*ImageJob, error)
+		ImageJobStatus(id string) (map[string]string, error)
+		NodeLost(nodeKey string, term int64) (int, error)
+		DrainNode(nodeKey string, term int64) ([]*DrainResult, error)
+		Reconcile(term int64) error
 	}
 	DefaultScheduler struct {
 		RedisPool *redis.Pool
+		RunPolicy RunPolicy
+		NodeName  string
+		Zone      string
+		Docker    *EngineClient
+		lock      sync.Mutex
 	}
 )
 
+var (
+	ErrJobNotFound = errors.New("No such job")
+	ErrJobRemoving = errors.New("Job instances are still being removed")
+)
+
+// Returns container job key
+func getContainerJobKey(name string) string {
+	return fmt.Sprintf("%s:%s", CONTAINER_JOB_KEY, name)
+}
+
+// Returns container job instances key
+func getJobInstancesKey(name string) string {
+	return fmt.Sprintf("%s:%s", JOB_INSTANCES_KEY, name)
+}
+
 func (s *DefaultScheduler) AddContainerJob(j *ContainerJob) (string, error) {
+	if j.Config == nil || j.Config.Name == "" {
+		return "", errors.New("Container job requires a config with a name")
+	}
 	// config
 	buf := bytes.NewBufferString("")
-	if err := json.NewEncoder(buf).Encode(j.Config); err != nil {
+	if err := json.NewEncoder(buf).Encode(j); err != nil {
 		return "", err
 	}
 	// add to redis
 	conn := s.RedisPool.Get()
-	k := fmt.Sprintf("%s:%s", CONTAINER_JOB_KEY, j.Config.Name)
-	conn.Do("SET", k, buf)
+	defer conn.Close()
+	// instances of a removed job with the same name are not adopted
+	removing, err := redis.Bool(conn.Do("SISMEMBER", REMOVED_JOBS_KEY, j.Config.Name))
+	if err != nil {
+		return "", err
+	}
+	if removing {
+		return "", ErrJobRemoving
+	}
+	conn.Send("MULTI")
+	conn.Send("SET", getContainerJobKey(j.Config.Name), buf)
+	conn.Send("SADD", CONTAINER_JOB_KEY, j.Config.Name)
+	// keep the history of a previously removed job with the same name
+	conn.Send("PERSIST", getJobHistoryKey(j.Config.Name))
+	if _, err := conn.Do("EXEC"); err != nil {
+		return "", err
+	}
 	log.Printf("Added container job %s for zone %s", j.Config.Name, j.Zone)
 	return j.Config.Name, nil
 }
-func (s *DefaultScheduler) RemoveContainerJob(id string) (bool, error) {
-	log.Printf("TODO: Removed job %s", id)
-	return true, nil
+
+// Removes the job and its instances ; instances that cannot be removed are
+// kept and retried by the reconciler
+func (s *DefaultScheduler) RemoveContainerJob(id string, term int64) ([]*InstanceResult, error) {
+	// prevent the reconciler from replacing instances while removing
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	results := []*InstanceResult{}
+	if err := s.checkTerm(term); err != nil {
+		return results, err
+	}
+	conn := s.RedisPool.Get()
+	conn.Send("MULTI")
+	conn.Send("DEL", getContainerJobKey(id))
+	conn.Send("SREM", CONTAINER_JOB_KEY, id)
+	conn.Send("SADD", REMOVED_JOBS_KEY, id)
+	r, err := redis.Values(conn.Do("EXEC"))
+	conn.Close()
+	if err != nil {
+		return results, err
+	}
+	if removed, _ := redis.Int(r[0], nil); removed == 0 {
+		// the job may have been removed with instances left to retry
+		conn := s.RedisPool.Get()
+		defer conn.Close()
+		if n, err := redis.Int(conn.Do("HLEN", getJobInstancesKey(id))); err != nil || n == 0 {
+			conn.Do("SREM", REMOVED_JOBS_KEY, id)
+			return results, ErrJobNotFound
+		}
+	}
+	log.Printf("Removed container job %s", id)
+	return s.removeJobInstances(id, term)
 }
-func (s *DefaultScheduler) AddImageJob(j *ImageJob) (bool, error) {
-	log.Printf("TODO: Added job %s", j.Image)
-	return true, nil
+
+// Removes the remaining instances of a removed job ; the job is forgotten
+// once no instances are left
+func (s *DefaultScheduler) removeJobInstances(id string, term int64) ([]*InstanceResult, error) {
+	results := []*InstanceResult{}
+	instances, err := s.getJobInstances(id)
+	if err != nil {
+		return results, err
+	}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for cId, nodeKey := range instances {
+		wg.Add(1)
+		go func(cId string, nodeKey string) {
+			defer wg.Done()
+			zone, name := parseNodeKey(nodeKey)
+			r := &InstanceResult{
+				Container: cId,
+				Node:      name,
+				Zone:      zone,
+			}
+			n, err := getNode(s.RedisPool, nodeKey)
+			switch {
+			case err != nil && isNodeWithinGrace(s.RedisPool, nodeKey):
+				r.Error = fmt.Sprintf("node unavailable: %s", err)
+			case err != nil:
+				// the node is gone and its containers with it
+				r.Removed = true
+			default:
+				if err := removeContainer(n, DOCKER_API_VERSION, cId); err != nil {
+					r.Error = err.Error()
+				} else {
+					r.Removed = true
+				}
+			}
+			if r.Removed {
+				if err := s.removeJobInstance(term, id, cId); err != nil {
+					r.Removed = false
+					r.Error = err.Error()
+				} else {
+					recordJobEvent(s.RedisPool, id, cId, nodeKey, JOB_STATE_REMOVED, "job removed")
+					unindexContainer(s.RedisPool, cId)
+				}
+			}
+			log.Printf("Job %s: removed instance %s on node %s: %v", id, cId, name, r.Removed)
+			lock.Lock()
+			results = append(results, r)
+			lock.Unlock()
+		}(cId, nodeKey)
+	}
+	wg.Wait()
+	for _, r := range results {
+		if !r.Removed {
+			log.Printf("Job %s: instance %s will be removed on the next pass", id, r.Container)
+			return results, nil
+		}
+	}
+	if err := s.checkTerm(term); err != nil {
+		return results, err
+	}
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SREM", REMOVED_JOBS_KEY, id); err != nil {
+		return results, err
+	}
+	if err := expireJobHistory(s.RedisPool, id); err != nil {
+		log.Printf("Error expiring history for job %s: %s", id, err)
+	}
+	return results, nil
+}
+
+// Retries removing the instances left by removed jobs
+func (s *DefaultScheduler) reconcileRemovedJobs(term int64) error {
+	conn := s.RedisPool.Get()
+	ids, err := redis.Strings(conn.Do("SMEMBERS", REMOVED_JOBS_KEY))
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := s.removeJobInstances(id, term); err != nil {
+			if err == ErrNotMaster {
+				return err
+			}
+			log.Printf("Error removing instances of job %s: %s", id, err)
+		}
+	}
+	return nil
+}
+func (s *DefaultScheduler) AddImageJob(j *ImageJob) (string, error) {
+	if j.Image == "" {
+		return "", errors.New("Image job requires an image")
+	}
+	buf := bytes.NewBufferString("")
+	if err := json.NewEncoder(buf).Encode(j); err != nil {
+		return "", err
+	}
+	nodes, err := getNodes(s.RedisPool, j.Zone)
+	if err != nil {
+		return "", err
+	}
+	id := getImageJobId(j)
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SET", getImageJobKey(id), buf)
+	conn.Send("SADD", IMAGE_JOB_KEY, id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return "", err
+	}
+	// reset status so every node in the zone pulls the image
+	statusKey := getImageJobStatusKey(id)
+	conn.Do("DEL", statusKey, getImageJobPullsKey(id))
+	for _, n := range nodes {
+		conn.Do("HSET", statusKey, n.Name, IMAGE_STATUS_PENDING)
+	}
+	log.Printf("Added image job %s for zone %s", j.Image, j.Zone)
+	return id, nil
 }
 func (s *DefaultScheduler) RemoveImageJob(id string) (bool, error) {
-	log.Printf("TODO: Removed job %s", id)
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("DEL", getImageJobKey(id), getImageJobStatusKey(id), getImageJobPullsKey(id))
+	conn.Send("SREM", IMAGE_JOB_KEY, id)
+	r, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	removed, _ := redis.Int(r[0], nil)
+	if removed == 0 {
+		return false, ErrJobNotFound
+	}
+	log.Printf("Removed image job %s", id)
 	return true, nil
 }
+
+// Returns the pull status of an image job for each node
+func (s *DefaultScheduler) ImageJobStatus(id string) (map[string]string, error) {
+	if _, err := s.GetImageJob(id); err != nil {
+		return nil, err
+	}
+	return getImageJobStatus(s.RedisPool, id)
+}
+
+// Returns all container jobs
+func (s *DefaultScheduler) ListContainerJobs() ([]*ContainerJob, error) {
+	jobs := []*ContainerJob{}
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	values, err := getIndexedValues(conn, CONTAINER_JOB_KEY, getContainerJobKey)
+	if err != nil {
+		return jobs, err
+	}
+	ids := []string{}
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		j := &ContainerJob{}
+		if err := json.Unmarshal(values[id], j); err != nil {
+			log.Printf("Error parsing container job %s: %s", id, err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// Returns the container job
+func (s *DefaultScheduler) GetContainerJob(id string) (*ContainerJob, error) {
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", getContainerJobKey(id)))
+	if err == redis.ErrNil {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	j := &ContainerJob{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Returns the containers and nodes of the job instances
+func (s *DefaultScheduler) ContainerJobInstances(id string) ([]*JobInstance, error) {
+	instances := []*JobInstance{}
+	if _, err := s.GetContainerJob(id); err != nil {
+		return instances, err
+	}
+	ids, err := s.getJobInstances(id)
+	if err != nil {
+		return instances, err
+	}
+	history, err := getJobHistory(s.RedisPool, id)
+	if err != nil {
+		return instances, err
+	}
+	records := make(map[string]*JobInstance)
+	for _, i := range history {
+		records[i.Container] = i
+	}
+	for cId, nodeKey := range ids {
+		i, ok := records[cId]
+		if !ok {
+			zone, name := parseNodeKey(nodeKey)
+			i = &JobInstance{
+				Job:       id,
+				Container: cId,
+				Node:      name,
+				Zone:      zone,
+			}
+		}
+		// history is available from ContainerJobHistory
+		i.History = nil
+		instances = append(instances, i)
+	}
+	sort.Sort(jobInstancesByCreated(instances))
+	return instances, nil
+}
+
+// Returns every tracked instance of the job including lost and removed
+// instances with their state transitions ; the history of a removed job is
+// available until it expires
+func (s *DefaultScheduler) ContainerJobHistory(id string) ([]*JobInstance, error) {
+	history, err := getJobHistory(s.RedisPool, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		if _, err := s.GetContainerJob(id); err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// Returns all image jobs keyed by id
+func (s *DefaultScheduler) ListImageJobs() (map[string]*ImageJob, error) {
+	return getImageJobs(s.RedisPool)
+}
+
+// Returns the image job
+func (s *DefaultScheduler) GetImageJob(id string) (*ImageJob, error) {
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", getImageJobKey(id)))
+	if err == redis.ErrNil {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	j := &ImageJob{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Returns the container ids and node keys of the job instances
+func (s *DefaultScheduler) getJobInstances(name string) (map[string]string, error) {
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	return redis.StringMap(conn.Do("HGETALL", getJobInstancesKey(name)))
+}
+
+// Returns ErrNotMaster if the scheduler node is no longer master for the term
+func (s *DefaultScheduler) checkTerm(term int64) error {
+	if !isMasterTerm(s.RedisPool, s.NodeName, term) {
+		return ErrNotMaster
+	}
+	return nil
+}
+
+// Returns the engine client if the node is the scheduler node
+func (s *DefaultScheduler) localClient(n *Node) *EngineClient {
+	if s.Docker == nil || n.Name != s.NodeName || n.Zone != s.Zone {
+		return nil
+	}
+	return s.Docker
+}
+
+// Returns a create func for the config ; containers on the scheduler node
+// are created through the engine client
+func (s *DefaultScheduler) creator(config *ContainerConfig) createFunc {
+	return func(n *Node, name string) (*CreatedContainer, error) {
+		client := s.localClient(n)
+		if client == nil {
+			return createContainer(n, DOCKER_API_VERSION, config, name)
+		}
+		cfg := *config
+		cfg.Name = name
+		c, err := client.CreateContainer(&cfg, nil)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", n.Name, err)
+		}
+		c.Node = n.Name
+		c.Zone = n.Zone
+		return c, nil
+	}
+}
+
+// Starts the container on the node ; containers on the scheduler node are
+// started through the engine client
+func (s *DefaultScheduler) startContainer(n *Node, id string, hostConfig *HostConfig) error {
+	if client := s.localClient(n); client != nil {
+		return client.StartContainer(id, hostConfig)
+	}
+	return startContainer(n, DOCKER_API_VERSION, id, hostConfig)
+}
+
+// Records the job instance if the scheduler node is still master for the term
+func (s *DefaultScheduler) addJobInstance(term int64, name string, id string, nodeKey string) error {
+	return fencedHSet(s.RedisPool, s.NodeName, term, getJobInstancesKey(name), id, nodeKey)
+}
+
+// Removes the job instance if the scheduler node is still master for the term
+func (s *DefaultScheduler) removeJobInstance(term int64, name string, id string) error {
+	return fencedHDel(s.RedisPool, s.NodeName, term, getJobInstancesKey(name), id)
+}
+
+// Marks the job instances on the node as lost so they are rescheduled ;
+// returns the number of lost instances
+func (s *DefaultScheduler) NodeLost(nodeKey string, term int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	jobs, err := s.ListContainerJobs()
+	if err != nil {
+		return 0, err
+	}
+	lost := 0
+	for _, j := range jobs {
+		instances, err := s.getJobInstances(j.Config.Name)
+		if err != nil {
+			return lost, err
+		}
+		for id, k := range instances {
+			if k != nodeKey {
+				continue
+			}
+			if err := s.removeJobInstance(term, j.Config.Name, id); err != nil {
+				return lost, err
+			}
+			recordJobEvent(s.RedisPool, j.Config.Name, id, nodeKey, JOB_STATE_LOST, "node heartbeat lost")
+			// the node removes the container if it comes back
+			addLostContainer(s.RedisPool, id, nodeKey)
+			unindexContainer(s.RedisPool, id)
+			lost++
+		}
+	}
+	return lost, nil
+}
+
+// Converges all container jobs to their desired number of instances ; the
+// term is verified before every change so a deposed master stops scheduling
+func (s *DefaultScheduler) Reconcile(term int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.reconcileRemovedJobs(term); err != nil {
+		return err
+	}
+	jobs, err := s.ListContainerJobs()
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if err := s.checkTerm(term); err != nil {
+			return err
+		}
+		if err := s.reconcileJob(j, term); err != nil {
+			if err == ErrNotMaster {
+				return err
+			}
+			log.Printf("Error reconciling job %s: %s", j.Config.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *DefaultScheduler) reconcileJob(j *ContainerJob, term int64) error {
+	config := *j.Config
+	if config.Zone == "" {
+		config.Zone = j.Zone
+	}
+	desired := int(config.NumberOfInstances)
+	if desired <= 0 {
+		desired = 1
+	}
+	instances, err := s.getJobInstances(config.Name)
+	if err != nil {
+		return err
+	}
+	// check existing instances ; instances on nodes within the grace period
+	// are kept apart so reachable instances are scaled down first
+	running := []string{}
+	unreachable := []string{}
+	for id, nodeKey := range instances {
+		n, err := getNode(s.RedisPool, nodeKey)
+		if err != nil {
+			if isNodeWithinGrace(s.RedisPool, nodeKey) {
+				// node may recover ; the reaper marks it lost after the grace period
+				unreachable = append(unreachable, id)
+				continue
+			}
+			log.Printf("Job %s: node for instance %s is gone", config.Name, id)
+			if err := s.removeJobInstance(term, config.Name, id); err != nil {
+				return err
+			}
+			recordJobEvent(s.RedisPool, config.Name, id, nodeKey, JOB_STATE_LOST, "node unavailable")
+			continue
+		}
+		c, err := inspectContainer(n, DOCKER_API_VERSION, id)
+		if err == ErrContainerNotFound {
+			log.Printf("Job %s: instance %s not found on node %s", config.Name, id, n.Name)
+			if err := s.removeJobInstance(term, config.Name, id); err != nil {
+				return err
+			}
+			recordJobEvent(s.RedisPool, config.Name, id, nodeKey, JOB_STATE_LOST, err.Error())
+			continue
+		}
+		if err != nil {
+			// keep the instance and retry on the next pass
+			log.Printf("Job %s: unable to inspect instance %s on node %s: %s", config.Name, id, n.Name, err)
+			running = append(running, id)
+			continue
+		}
+		if !c.State.Running {
+			if err := s.checkTerm(term); err != nil {
+				return err
+			}
+			if err := s.startContainer(n, id, j.HostConfig); err != nil {
+				log.Printf("Job %s: unable to restart instance %s on node %s: %s", config.Name, id, n.Name, err)
+				if err := s.checkTerm(term); err != nil {
+					return err
+				}
+				removeContainer(n, DOCKER_API_VERSION, id)
+				if err := s.removeJobInstance(term, config.Name, id); err != nil {
+					return err
+				}
+				recordJobEvent(s.RedisPool, config.Name, id, nodeKey, JOB_STATE_FAILED, err.Error())
+				continue
+			}
+			recordJobEvent(s.RedisPool, config.Name, id, nodeKey, JOB_STATE_RUNNING, "restarted")
+		}
+		running = append(running, id)
+	}
+	running = append(unreachable, running...)
+	switch {
+	case len(running) < desired:
+		config.NumberOfInstances = int64(desired - len(running))
+		log.Printf("Job %s: scheduling %d instance(s)", config.Name, config.NumberOfInstances)
+		check := func() error {
+			return s.checkTerm(term)
+		}
+		containers, placeErr := placeContainers(s.RedisPool, s.RunPolicy, &config, "", s.creator(&config), check)
+		for _, c := range containers {
+			nodeKey := getNodeKey(c.Node, c.Zone)
+			n, err := getNode(s.RedisPool, nodeKey)
+			if err := s.addJobInstance(term, config.Name, c.Id, nodeKey); err != nil {
+				// the new master does not know about the instance
+				if n != nil {
+					removeContainer(n, DOCKER_API_VERSION, c.Id)
+				}
+				return err
+			}
+			recordJobEvent(s.RedisPool, config.Name, c.Id, nodeKey, JOB_STATE_SCHEDULED, "")
+			if err != nil {
+				continue
+			}
+			if err := s.startContainer(n, c.Id, j.HostConfig); err != nil {
+				log.Printf("Job %s: unable to start instance %s on node %s: %s", config.Name, c.Id, n.Name, err)
+				recordJobEvent(s.RedisPool, config.Name, c.Id, nodeKey, JOB_STATE_FAILED, err.Error())
+				continue
+			}
+			recordJobEvent(s.RedisPool, config.Name, c.Id, nodeKey, JOB_STATE_RUNNING, "")
+		}
+		return placeErr
+	case len(running) > desired:
+		log.Printf("Job %s: removing %d instance(s)", config.Name, len(running)-desired)
+		for _, id := range running[desired:] {
+			nodeKey := instances[id]
+			if err := s.checkTerm(term); err != nil {
+				return err
+			}
+			if n, err := getNode(s.RedisPool, nodeKey); err == nil {
+				if err := removeContainer(n, DOCKER_API_VERSION, id); err != nil {
+					log.Printf("Job %s: unable to remove instance %s on node %s: %s", config.Name, id, n.Name, err)
+					continue
+				}
+			} else {
+				// the node removes the container if it comes back
+				addLostContainer(s.RedisPool, id, nodeKey)
+			}
+			if err := s.removeJobInstance(term, config.Name, id); err != nil {
+				return err
+			}
+			recordJobEvent(s.RedisPool, config.Name, id, nodeKey, JOB_STATE_REMOVED, "scaled down")
+			unindexContainer(s.RedisPool, id)
+		}
+	}
+	return nil
+}
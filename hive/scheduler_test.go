@@ -0,0 +1,336 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package hive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Returns a scheduler that is master for the returned term
+func newTestScheduler(t *testing.T) (*DefaultScheduler, int64) {
+	pool := newTestPool(t)
+	s := &DefaultScheduler{RedisPool: pool, RunPolicy: &RandomPolicy{RedisPool: pool}, NodeName: "master"}
+	term, err := electMaster(pool, s.NodeName)
+	if err != nil || term == 0 {
+		t.Fatalf("Error electing master: %v", err)
+	}
+	return s, term
+}
+
+// Adds a job with an instance running on the node
+func addTestJob(t *testing.T, s *DefaultScheduler, term int64, node *fakeNode, instances int64) *ContainerJob {
+	j := &ContainerJob{
+		Config: &ContainerConfig{Name: "web", Image: "busybox", NumberOfInstances: instances},
+		Zone:   "default",
+	}
+	if _, err := s.AddContainerJob(j); err != nil {
+		t.Fatalf("Error adding job: %s", err)
+	}
+	if node != nil {
+		id := node.Name + "-web"
+		node.AddContainer(id, j.Config, true)
+		nodeKey := getNodeKey(node.Name, "default")
+		if err := s.addJobInstance(term, j.Config.Name, id, nodeKey); err != nil {
+			t.Fatalf("Error adding job instance: %s", err)
+		}
+		addManagedContainer(s.RedisPool, id, nodeKey)
+	}
+	return j
+}
+
+func TestGetContainerJobKey(t *testing.T) {
+	testKey := "jobs:containers:web"
+	key := getContainerJobKey("web")
+	if key != testKey {
+		t.Fatalf("Error: expected %s ; received: %s", testKey, key)
+	}
+}
+
+func TestGetJobInstancesKey(t *testing.T) {
+	testKey := "jobs:instances:web"
+	key := getJobInstancesKey("web")
+	if key != testKey {
+		t.Fatalf("Error: expected %s ; received: %s", testKey, key)
+	}
+}
+
+func TestAddContainerJobRequiresName(t *testing.T) {
+	s := &DefaultScheduler{}
+	if _, err := s.AddContainerJob(&ContainerJob{Config: &ContainerConfig{}}); err == nil {
+		t.Fatalf("Error: expected error for job without a name")
+	}
+}
+
+func TestJobInstanceWritesRequireMasterTerm(t *testing.T) {
+	s, term := newTestScheduler(t)
+	if err := s.addJobInstance(term, "web", "c1", "nodes:default:node1"); err != nil {
+		t.Fatalf("Error adding job instance: %s", err)
+	}
+	// another node takes over with a new term
+	conn := s.RedisPool.Get()
+	conn.Do("INCR", MASTER_TERM_KEY)
+	conn.Close()
+	if err := s.addJobInstance(term, "web", "c2", "nodes:default:node1"); err != ErrNotMaster {
+		t.Fatalf("Error: expected %v ; received: %v", ErrNotMaster, err)
+	}
+	if err := s.removeJobInstance(term, "web", "c1"); err != ErrNotMaster {
+		t.Fatalf("Error: expected %v ; received: %v", ErrNotMaster, err)
+	}
+	instances, err := s.getJobInstances("web")
+	if err != nil {
+		t.Fatalf("Error getting job instances: %s", err)
+	}
+	if len(instances) != 1 || instances["c1"] == "" {
+		t.Fatalf("Error: expected only instance c1 ; received: %v", instances)
+	}
+}
+
+func TestReconcileStopsWhenDeposed(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node := newFakeNode(t, s.RedisPool, "node1", "default")
+	addTestJob(t, s, term, nil, 2)
+	conn := s.RedisPool.Get()
+	conn.Do("INCR", MASTER_TERM_KEY)
+	conn.Close()
+	if err := s.Reconcile(term); err != ErrNotMaster {
+		t.Fatalf("Error: expected %v ; received: %v", ErrNotMaster, err)
+	}
+	if containers := node.Containers(); len(containers) != 0 {
+		t.Fatalf("Error: expected no containers created ; received: %v", containers)
+	}
+}
+
+func TestReconcileSchedulesMissingInstances(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node := newFakeNode(t, s.RedisPool, "node1", "default")
+	addTestJob(t, s, term, node, 2)
+	if err := s.Reconcile(term); err != nil {
+		t.Fatalf("Error reconciling: %s", err)
+	}
+	instances, err := s.getJobInstances("web")
+	if err != nil {
+		t.Fatalf("Error getting job instances: %s", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("Error: expected 2 instances ; received: %v", instances)
+	}
+	if containers := node.Containers(); len(containers) != 2 {
+		t.Fatalf("Error: expected 2 containers ; received: %v", containers)
+	}
+}
+
+func TestReconcileUsesEngineClientForLocalNode(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node := newFakeNode(t, s.RedisPool, s.NodeName, "default")
+	// the node address is unreachable so only the engine client can place
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	registerTestNode(t, s.RedisPool, s.NodeName, "default", down.URL)
+	s.Zone = "default"
+	s.Docker = newTestEngineClient(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Path = "/" + DOCKER_API_VERSION + req.URL.Path
+		node.ServeHTTP(w, req)
+	}))
+	addTestJob(t, s, term, nil, 1)
+	if err := s.Reconcile(term); err != nil {
+		t.Fatalf("Error reconciling: %s", err)
+	}
+	containers := node.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("Error: expected 1 container on the local node ; received: %v", containers)
+	}
+	c, err := s.Docker.InspectContainer(containers[0])
+	if err != nil {
+		t.Fatalf("Error inspecting container: %s", err)
+	}
+	if !c.State.Running {
+		t.Fatalf("Error: expected container %s to be started", c.Id)
+	}
+}
+
+func TestReconcileReplacesNotFoundInstance(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node := newFakeNode(t, s.RedisPool, "node1", "default")
+	addTestJob(t, s, term, nil, 1)
+	if err := s.addJobInstance(term, "web", "gone", getNodeKey("node1", "default")); err != nil {
+		t.Fatalf("Error adding job instance: %s", err)
+	}
+	if err := s.Reconcile(term); err != nil {
+		t.Fatalf("Error reconciling: %s", err)
+	}
+	instances, err := s.getJobInstances("web")
+	if err != nil {
+		t.Fatalf("Error getting job instances: %s", err)
+	}
+	if _, ok := instances["gone"]; ok || len(instances) != 1 {
+		t.Fatalf("Error: expected missing instance replaced ; received: %v", instances)
+	}
+	if containers := node.Containers(); len(containers) != 1 {
+		t.Fatalf("Error: expected 1 container ; received: %v", containers)
+	}
+}
+
+func TestReconcileKeepsInstanceOnInspectError(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node := newFakeNode(t, s.RedisPool, "node1", "default")
+	addTestJob(t, s, term, node, 1)
+	node.InspectStatus = 500
+	if err := s.Reconcile(term); err != nil {
+		t.Fatalf("Error reconciling: %s", err)
+	}
+	instances, err := s.getJobInstances("web")
+	if err != nil {
+		t.Fatalf("Error getting job instances: %s", err)
+	}
+	if len(instances) != 1 || instances["node1-web"] == "" {
+		t.Fatalf("Error: expected instance node1-web kept ; received: %v", instances)
+	}
+	if containers := node.Containers(); len(containers) != 1 {
+		t.Fatalf("Error: expected no new containers ; received: %v", containers)
+	}
+}
+
+func TestReconcileScalesDownReachableInstancesFirst(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node := newFakeNode(t, s.RedisPool, "node1", "default")
+	j := addTestJob(t, s, term, node, 1)
+	// the late node missed its heartbeats but is still within the grace period
+	setTestHeartbeat(t, s.RedisPool, "late", "default", time.Now())
+	lateKey := getNodeKey("late", "default")
+	for _, id := range []string{"late-1", "late-2"} {
+		if err := s.addJobInstance(term, j.Config.Name, id, lateKey); err != nil {
+			t.Fatalf("Error adding job instance: %s", err)
+		}
+	}
+	if err := s.Reconcile(term); err != nil {
+		t.Fatalf("Error reconciling: %s", err)
+	}
+	if removed := node.Removed(); len(removed) != 1 || removed[0] != "node1-web" {
+		t.Fatalf("Error: expected node1-web removed ; received: %v", removed)
+	}
+	instances, err := s.getJobInstances(j.Config.Name)
+	if err != nil {
+		t.Fatalf("Error getting job instances: %s", err)
+	}
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+	lost, err := redis.Strings(conn.Do("SMEMBERS", getLostContainersKey(lateKey)))
+	if err != nil {
+		t.Fatalf("Error getting lost containers: %s", err)
+	}
+	if len(instances) != 1 || len(lost) != 1 || instances[lost[0]] != "" {
+		t.Fatalf("Error: expected one late instance kept and one lost ; received: %v %v", instances, lost)
+	}
+}
+
+func TestRemoveContainerJobKeepsFailedInstances(t *testing.T) {
+	s, term := newTestScheduler(t)
+	node := newFakeNode(t, s.RedisPool, "node1", "default")
+	addTestJob(t, s, term, node, 1)
+	node.RemoveStatus = 500
+	results, err := s.RemoveContainerJob("web", term)
+	if err != nil {
+		t.Fatalf("Error removing job: %s", err)
+	}
+	if len(results) != 1 || results[0].Removed {
+		t.Fatalf("Error: expected failed instance removal ; received: %+v", results)
+	}
+	instances, err := s.getJobInstances("web")
+	if err != nil {
+		t.Fatalf("Error getting job instances: %s", err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("Error: expected failed instance kept ; received: %v", instances)
+	}
+	if _, err := s.AddContainerJob(&ContainerJob{Config: &ContainerConfig{Name: "web"}}); err != ErrJobRemoving {
+		t.Fatalf("Error: expected %v ; received: %v", ErrJobRemoving, err)
+	}
+
+	// the reconciler retries the removal
+	node.RemoveStatus = 0
+	if err := s.Reconcile(term); err != nil {
+		t.Fatalf("Error reconciling: %s", err)
+	}
+	if removed := node.Removed(); len(removed) != 1 || removed[0] != "node1-web" {
+		t.Fatalf("Error: expected node1-web removed ; received: %v", removed)
+	}
+	instances, err = s.getJobInstances("web")
+	if err != nil {
+		t.Fatalf("Error getting job instances: %s", err)
+	}
+	if len(instances) != 0 {
+		t.Fatalf("Error: expected no instances ; received: %v", instances)
+	}
+	if _, err := s.RemoveContainerJob("web", term); err != ErrJobNotFound {
+		t.Fatalf("Error: expected %v ; received: %v", ErrJobNotFound, err)
+	}
+}
+
+func TestRemoveContainerJobRequiresMaster(t *testing.T) {
+	s, term := newTestScheduler(t)
+	addTestJob(t, s, term, nil, 1)
+	conn := s.RedisPool.Get()
+	conn.Do("INCR", MASTER_TERM_KEY)
+	conn.Close()
+	if _, err := s.RemoveContainerJob("web", term); err != ErrNotMaster {
+		t.Fatalf("Error: expected %v ; received: %v", ErrNotMaster, err)
+	}
+	if _, err := s.GetContainerJob("web"); err != nil {
+		t.Fatalf("Error: expected job kept ; received: %v", err)
+	}
+}
+
+func TestListJobsFromIndex(t *testing.T) {
+	s, term := newTestScheduler(t)
+	for _, name := range []string{"web", "db"} {
+		if _, err := s.AddContainerJob(&ContainerJob{Config: &ContainerConfig{Name: name, Image: "busybox"}}); err != nil {
+			t.Fatalf("Error adding job: %s", err)
+		}
+	}
+	if _, err := s.RemoveContainerJob("web", term); err != nil {
+		t.Fatalf("Error removing job: %s", err)
+	}
+	jobs, err := s.ListContainerJobs()
+	if err != nil {
+		t.Fatalf("Error listing jobs: %s", err)
+	}
+	if len(jobs) != 1 || jobs[0].Config.Name != "db" {
+		t.Fatalf("Error: expected job db ; received: %v", jobs)
+	}
+
+	id, err := s.AddImageJob(&ImageJob{Image: "busybox"})
+	if err != nil {
+		t.Fatalf("Error adding image job: %s", err)
+	}
+	imageJobs, err := s.ListImageJobs()
+	if err != nil {
+		t.Fatalf("Error listing image jobs: %s", err)
+	}
+	if len(imageJobs) != 1 || imageJobs[id] == nil {
+		t.Fatalf("Error: expected image job %s ; received: %v", id, imageJobs)
+	}
+	if _, err := s.RemoveImageJob(id); err != nil {
+		t.Fatalf("Error removing image job: %s", err)
+	}
+	if imageJobs, _ := s.ListImageJobs(); len(imageJobs) != 0 {
+		t.Fatalf("Error: expected no image jobs ; received: %v", imageJobs)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/ehazlett/docker-hive/hive"
@@ -32,7 +33,12 @@ const (
 )
 
 var (
-	dockerPath string
+	dockerHost string
+	dockerCert string
+	dockerKey  string
+	dockerCA   string
+	dockerDial time.Duration
+	dockerTime time.Duration
 	version    bool
 	nodeName   string
 	port       int
@@ -42,16 +48,45 @@ var (
 	redisPass  string
 	zone       string
 	runPolicy  string
+	labels     = labelFlag{}
+	cordon     string
+	uncordon   string
+	drain      string
 )
 
+// Node labels specified as repeated key=value flags
+type labelFlag map[string]string
+
+func (l labelFlag) String() string {
+	return fmt.Sprintf("%v", map[string]string(l))
+}
+
+func (l labelFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid label %q: expected key=value", value)
+	}
+	l[parts[0]] = parts[1]
+	return nil
+}
+
 func init() {
-	flag.StringVar(&dockerPath, "docker", "/var/run/docker.sock", "Path to Docker socket")
+	flag.StringVar(&dockerHost, "docker", "unix:///var/run/docker.sock", "Docker endpoint (unix://, tcp:// or https://)")
+	flag.StringVar(&dockerCert, "docker-cert", "", "TLS client certificate for Docker")
+	flag.StringVar(&dockerKey, "docker-key", "", "TLS client key for Docker")
+	flag.StringVar(&dockerCA, "docker-ca", "", "TLS CA certificate to verify Docker")
+	flag.DurationVar(&dockerDial, "docker-dial-timeout", utils.DEFAULT_DOCKER_DIAL_TIMEOUT*time.Second, "Timeout connecting to Docker")
+	flag.DurationVar(&dockerTime, "docker-timeout", utils.DEFAULT_DOCKER_TIMEOUT*time.Second, "Timeout for Docker API calls made by the node")
 	flag.BoolVar(&version, "version", false, "Shows version")
 	flag.StringVar(&nodeName, "n", "", "Node name (default: hostname)")
 	flag.StringVar(&host, "l", "", "Listen address (also used for communication with ndoes)")
 	flag.IntVar(&port, "p", 4500, "Listen port")
 	flag.StringVar(&zone, "z", "default", "Zone for node")
-	flag.StringVar(&runPolicy, "r", "default", "Run Policy")
+	flag.Var(labels, "label", "Node label as key=value (can be specified multiple times)")
+	flag.StringVar(&runPolicy, "r", "default", "Run Policy (random, unique, binpack, spread)")
+	flag.StringVar(&cordon, "cordon", "", "Mark node in zone unschedulable and exit")
+	flag.StringVar(&uncordon, "uncordon", "", "Mark node in zone schedulable and exit")
+	flag.StringVar(&drain, "drain", "", "Move containers off of node in zone and exit")
 	flag.StringVar(&redisHost, "redis-host", "localhost", "Redis hostname")
 	flag.IntVar(&redisPort, "redis-port", 6379, "Redis port")
 	flag.StringVar(&redisPass, "redis-password", "", "Redis password")
@@ -73,6 +108,11 @@ func main() {
 	log.SetFlags(log.LstdFlags)
 	log.Printf("Docker Hive %s\n", VERSION)
 
+	endpoint, err := utils.ParseDockerEndpoint(dockerHost, dockerCert, dockerKey, dockerCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	docker := utils.NewDockerClient(endpoint, dockerDial, dockerTime)
 	// connect to redis
 	pool := utils.NewRedisPool(redisHost, redisPort, redisPass)
 	// set node name
@@ -84,8 +124,34 @@ func main() {
 		}
 		nodeName = name
 	}
-	// start node
-	engine := hive.NewEngine(host, port, dockerPath, VERSION, nodeName, zone, pool, runPolicy)
+	engine := hive.NewEngine(host, port, docker, VERSION, nodeName, zone, labels, pool, runPolicy)
+
+	// node maintenance
+	switch {
+	case cordon != "":
+		if err := engine.CordonNode(cordon, zone); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case uncordon != "":
+		if err := engine.UncordonNode(uncordon, zone); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case drain != "":
+		results, err := engine.DrainNode(drain, zone)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range results {
+			if r.Error != "" {
+				log.Printf("Error moving container %s: %s", r.Container, r.Error)
+				continue
+			}
+			log.Printf("Moved container %s to %s on node %s", r.Container, r.NewContainer, r.NewNode)
+		}
+		return
+	}
 
 	waiter, err := engine.Start()
 	if err != nil {
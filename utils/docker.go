@@ -0,0 +1,275 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_DOCKER_PORT         = 2375
+	DEFAULT_DOCKER_TLS_PORT     = 2376
+	DOCKER_MAX_IDLE_CONNS       = 10
+	DOCKER_IDLE_CONN_TIMEOUT    = 90
+	DOCKER_KEEP_ALIVE_INTERVAL  = 30
+	DEFAULT_DOCKER_DIAL_TIMEOUT = 5
+	DEFAULT_DOCKER_TIMEOUT      = 30
+)
+
+type (
+	// Docker daemon address ; a unix socket or a tcp address with optional TLS
+	DockerEndpoint struct {
+		Network   string
+		Addr      string
+		TLSConfig *tls.Config
+	}
+
+	// Docker API client sharing a pool of connections to the daemon
+	DockerClient struct {
+		Endpoint *DockerEndpoint
+		// Timeout for API calls ; streamed and proxied requests are not limited
+		Timeout    time.Duration
+		dialer     *net.Dialer
+		httpClient *http.Client
+		baseURL    *url.URL
+	}
+
+	// Error response from the Docker daemon
+	DockerError struct {
+		StatusCode int
+		Message    string
+	}
+)
+
+// Parses a Docker endpoint (i.e. unix:///var/run/docker.sock, tcp://host:2375
+// or https://host:2376) ; a bare path is treated as a unix socket.  TLS is
+// used for https and for tcp when a certificate or CA is specified.
+func ParseDockerEndpoint(addr string, cert string, key string, ca string) (*DockerEndpoint, error) {
+	if addr == "" {
+		return nil, errors.New("Docker endpoint not specified")
+	}
+	if strings.HasPrefix(addr, "/") {
+		return &DockerEndpoint{Network: "unix", Addr: addr}, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	useTLS := cert != "" || ca != ""
+	port := DEFAULT_DOCKER_PORT
+	switch u.Scheme {
+	case "unix":
+		return &DockerEndpoint{Network: "unix", Addr: u.Path}, nil
+	case "tcp":
+	case "https":
+		useTLS = true
+	default:
+		return nil, fmt.Errorf("Unsupported Docker endpoint %s: expected unix, tcp or https", addr)
+	}
+	if useTLS {
+		port = DEFAULT_DOCKER_TLS_PORT
+	}
+	host := u.Host
+	if host == "" {
+		return nil, fmt.Errorf("Invalid Docker endpoint %s: missing host", addr)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	}
+	d := &DockerEndpoint{Network: "tcp", Addr: host}
+	if useTLS {
+		cfg, err := newTLSConfig(cert, key, ca)
+		if err != nil {
+			return nil, err
+		}
+		d.TLSConfig = cfg
+	}
+	return d, nil
+}
+
+// Returns the TLS client config for the certificate, key and CA files
+func newTLSConfig(cert string, key string, ca string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if cert != "" || key != "" {
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading Docker client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{c}
+	}
+	// system roots are used when no CA is specified
+	if ca != "" {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading Docker CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("Error loading Docker CA: no certificates found in %s", ca)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// Returns the endpoint URL
+func (d *DockerEndpoint) String() string {
+	switch {
+	case d.Network == "unix":
+		return fmt.Sprintf("unix://%s", d.Addr)
+	case d.TLSConfig != nil:
+		return fmt.Sprintf("https://%s", d.Addr)
+	}
+	return fmt.Sprintf("tcp://%s", d.Addr)
+}
+
+// Creates a new Docker client for the endpoint ; connections are kept alive
+// and reused across requests
+func NewDockerClient(docker *DockerEndpoint, dialTimeout time.Duration, timeout time.Duration) *DockerClient {
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: DOCKER_KEEP_ALIVE_INTERVAL * time.Second,
+	}
+	transport := &http.Transport{
+		// the request address is ignored so unix sockets can be used
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, docker.Network, docker.Addr)
+		},
+		TLSClientConfig:     docker.TLSConfig,
+		TLSHandshakeTimeout: dialTimeout,
+		MaxIdleConns:        DOCKER_MAX_IDLE_CONNS,
+		MaxIdleConnsPerHost: DOCKER_MAX_IDLE_CONNS,
+		IdleConnTimeout:     DOCKER_IDLE_CONN_TIMEOUT * time.Second,
+	}
+	base := &url.URL{Scheme: "http", Host: docker.Addr}
+	if docker.Network == "unix" {
+		base.Host = "docker"
+	}
+	if docker.TLSConfig != nil {
+		base.Scheme = "https"
+	}
+	return &DockerClient{
+		Endpoint:   docker,
+		Timeout:    timeout,
+		dialer:     dialer,
+		httpClient: &http.Client{Transport: transport},
+		baseURL:    base,
+	}
+}
+
+// Performs the request against the Docker daemon ; the request URL only
+// needs the path and query
+func (c *DockerClient) Do(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = c.baseURL.Scheme
+	req.URL.Host = c.baseURL.Host
+	return c.httpClient.Do(req)
+}
+
+// Opens a dedicated connection to the Docker daemon (i.e. for hijacked requests)
+func (c *DockerClient) Dial() (net.Conn, error) {
+	d := c.Endpoint
+	if d.TLSConfig != nil {
+		return tls.DialWithDialer(c.dialer, d.Network, d.Addr, d.TLSConfig)
+	}
+	return c.dialer.Dial(d.Network, d.Addr)
+}
+
+// Performs an API call encoding in as the request body and decoding the
+// response into out ; either can be nil
+func (c *DockerClient) DoJSON(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := CheckDockerResponse(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Performs a GET and decodes the JSON response into v
+func (c *DockerClient) GetJSON(path string, v interface{}) error {
+	return c.DoJSON("GET", path, nil, v)
+}
+
+// Returns a DockerError if the response is not successful
+func CheckDockerResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	msg := strings.TrimSpace(string(data))
+	// newer daemons return {"message": ...}
+	e := struct {
+		Message string `json:"message"`
+	}{}
+	if json.Unmarshal(data, &e) == nil && e.Message != "" {
+		msg = e.Message
+	}
+	return &DockerError{StatusCode: resp.StatusCode, Message: msg}
+}
+
+func (e *DockerError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Docker returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("Docker returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// Returns true if the error is a Docker error with the status code
+func IsDockerStatus(err error, status int) bool {
+	var e *DockerError
+	return errors.As(err, &e) && e.StatusCode == status
+}
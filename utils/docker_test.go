@@ -0,0 +1,95 @@
+/*
+   Copyright Evan Hazlett
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package utils
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseDockerEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"/var/run/docker.sock":        "unix:///var/run/docker.sock",
+		"unix:///var/run/docker.sock": "unix:///var/run/docker.sock",
+		"tcp://10.0.0.1":              "tcp://10.0.0.1:2375",
+		"tcp://10.0.0.1:4243":         "tcp://10.0.0.1:4243",
+		"https://docker.local":        "https://docker.local:2376",
+	}
+	for addr, expected := range tests {
+		d, err := ParseDockerEndpoint(addr, "", "", "")
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", addr, err)
+		}
+		if d.String() != expected {
+			t.Fatalf("Error: expected %s ; received: %s", expected, d.String())
+		}
+	}
+	if _, err := ParseDockerEndpoint("ftp://docker.local", "", "", ""); err == nil {
+		t.Fatalf("Error: expected error for unsupported scheme")
+	}
+	if _, err := ParseDockerEndpoint("tcp://docker.local", "", "", "/nonexistent/ca.pem"); err == nil {
+		t.Fatalf("Error: expected error for missing CA")
+	}
+}
+
+func TestDockerClientReusesConnections(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Error listening on %s: %s", sock, err)
+	}
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/version" {
+			http.Error(w, "No such container", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Version": "1.0.0"}`))
+	}))
+	srv.Listener = l
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	c := NewDockerClient(&DockerEndpoint{Network: "unix", Addr: sock}, time.Second, time.Second)
+	for i := 0; i < 3; i++ {
+		v := struct {
+			Version string
+		}{}
+		if err := c.GetJSON("/version", &v); err != nil {
+			t.Fatalf("Error getting version: %s", err)
+		}
+		if v.Version != "1.0.0" {
+			t.Fatalf("Error: expected version 1.0.0 ; received: %s", v.Version)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("Error: expected 1 connection ; received: %d", n)
+	}
+	err = c.GetJSON("/containers/foo/json", nil)
+	if !IsDockerStatus(err, http.StatusNotFound) {
+		t.Fatalf("Error: expected not found ; received: %v", err)
+	}
+}
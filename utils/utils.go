@@ -16,12 +16,15 @@
 package utils
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -29,10 +32,40 @@ import (
 )
 
 const (
-	DEFAULT_POOL_SIZE = 10
+	DEFAULT_POOL_SIZE     = 10
+	NODE_DIAL_TIMEOUT     = 5
+	NODE_RESPONSE_TIMEOUT = 30
 )
 
-var onExitFlushLoop func()
+var (
+	// Client for requests between hive nodes ; an unreachable node fails
+	// the request instead of hanging it
+	NodeClient = NewNodeClient(NODE_DIAL_TIMEOUT*time.Second, NODE_RESPONSE_TIMEOUT*time.Second)
+
+	// Client for node requests that may wait for the response (i.e. wait,
+	// events, drains) ; only the dial is limited
+	NodeStreamClient = NewNodeClient(NODE_DIAL_TIMEOUT*time.Second, 0)
+
+	onExitFlushLoop func()
+)
+
+// Creates an HTTP client for hive node requests ; a zero response timeout
+// waits for the response headers indefinitely
+func NewNodeClient(dialTimeout time.Duration, responseTimeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: DOCKER_KEEP_ALIVE_INTERVAL * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   dialTimeout,
+			ResponseHeaderTimeout: responseTimeout,
+			MaxIdleConnsPerHost:   DOCKER_MAX_IDLE_CONNS,
+			IdleConnTimeout:       DOCKER_IDLE_CONN_TIMEOUT * time.Second,
+		},
+	}
+}
 
 func NewRedisPool(addr string, port int, password string) *redis.Pool {
 	return redis.NewPool(func() (redis.Conn, error) {
@@ -49,15 +82,6 @@ func NewRedisPool(addr string, port int, password string) *redis.Pool {
 	}, DEFAULT_POOL_SIZE)
 }
 
-// Creates a new Docker client using the Docker unix socket.
-func NewDockerClient(dockerSocketPath string) (*httputil.ClientConn, error) {
-	conn, err := net.Dial("unix", dockerSocketPath)
-	if err != nil {
-		return nil, err
-	}
-	return httputil.NewClientConn(conn, nil), nil
-}
-
 // Utility function for copying HTTP Headers.
 func copyHeaders(src, dst http.Header) {
 	for k, vv := range src {
@@ -68,41 +92,176 @@ func copyHeaders(src, dst http.Header) {
 }
 
 // Proxies request to local Docker instance.
-func ProxyLocalDockerRequest(w http.ResponseWriter, req *http.Request, dockerPath string) {
+func ProxyLocalDockerRequest(w http.ResponseWriter, req *http.Request, docker *DockerClient) {
 	req.ParseForm()
 	params := req.Form
 	path := fmt.Sprintf("%s?%s", req.URL.Path, params.Encode())
 	log.Printf("Proxying Docker request: %s", path)
-	c, err := NewDockerClient(dockerPath)
-	defer c.Close()
+	if isHijackRequest(req) {
+		hijackRequest(w, req, docker.Dial, docker.Endpoint.Addr, path)
+		return
+	}
+	r, err := http.NewRequest(req.Method, path, req.Body)
 	if err != nil {
-		msg := fmt.Sprintf("Error connecting to Docker: %s", err)
-		log.Println(msg)
-		w.Write([]byte(msg))
+		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("Error making request to Docker: %s", err))
+		return
+	}
+	copyHeaders(req.Header, r.Header)
+	r.ContentLength = req.ContentLength
+	resp, err := docker.Do(r)
+	if err != nil {
+		WriteError(w, proxyErrorStatus(err), fmt.Sprintf("Error performing request to Docker: %s", err))
+		return
+	}
+	defer resp.Body.Close()
+	copyHeaders(resp.Header, w.Header())
+	w.WriteHeader(resp.StatusCode)
+	copyResponse(w, resp.Body, flushInterval(resp))
+}
+
+// Proxies request to a remote Docker API endpoint (i.e. another hive node).
+func ProxyRemoteRequest(w http.ResponseWriter, req *http.Request, addr string) {
+	path := fmt.Sprintf("%s%s", addr, req.URL.RequestURI())
+	log.Printf("Proxying Docker request: %s", path)
+	if isHijackRequest(req) {
+		u, err := url.Parse(addr)
+		if err != nil {
+			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("Error parsing address %s: %s", addr, err))
+			return
+		}
+		dial := func() (net.Conn, error) {
+			return net.DialTimeout("tcp", u.Host, NODE_DIAL_TIMEOUT*time.Second)
+		}
+		hijackRequest(w, req, dial, u.Host, req.URL.RequestURI())
 		return
 	}
 	r, err := http.NewRequest(req.Method, path, req.Body)
 	if err != nil {
-		msg := fmt.Sprintf("Error making request to Docker: %s", err)
-		log.Println(msg)
-		w.Write([]byte(msg))
+		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("Error making request to %s: %s", addr, err))
 		return
 	}
-	resp, err := c.Do(r)
+	copyHeaders(req.Header, r.Header)
+	client := NodeClient
+	if isLongPollRequest(req) {
+		client = NodeStreamClient
+	}
+	resp, err := client.Do(r)
 	if err != nil {
-		msg := fmt.Sprintf("Error performing request to Docker: %s", err)
-		w.WriteHeader(resp.StatusCode)
-		w.Write([]byte(msg))
+		WriteError(w, proxyErrorStatus(err), fmt.Sprintf("Error performing request to %s: %s", addr, err))
 		return
 	}
+	defer resp.Body.Close()
 	copyHeaders(resp.Header, w.Header())
 	w.WriteHeader(resp.StatusCode)
-	copyResponse(w, resp.Body, time.Duration(0))
+	copyResponse(w, resp.Body, flushInterval(resp))
+}
+
+// Returns true if the response headers are only sent once an event occurs
+func isLongPollRequest(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/wait") || strings.HasSuffix(req.URL.Path, "/events")
+}
+
+// Writes a Docker style JSON error so clients show the message
+func WriteError(w http.ResponseWriter, status int, msg string) {
+	log.Println(msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+// Returns the status for an upstream error ; 503 if the daemon is not
+// accepting connections, 504 on timeouts and 502 otherwise
+func proxyErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// Returns true if Docker takes over the connection for the request
+// (i.e. attach and exec)
+func isHijackRequest(req *http.Request) bool {
+	if strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade") {
+		return true
+	}
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	if strings.Contains(path, "/containers/") && strings.HasSuffix(path, "/attach") {
+		return true
+	}
+	return req.Method == "POST" && strings.Contains(path, "/exec/") && strings.HasSuffix(path, "/start")
+}
+
+// Returns the flush interval for the response ; streamed responses
+// (i.e. logs, events and pull progress) are flushed on every write
+func flushInterval(resp *http.Response) time.Duration {
+	if resp.ContentLength == -1 {
+		return -1
+	}
+	return time.Duration(0)
+}
+
+// Forwards the request over a raw connection and pipes the hijacked client
+// connection to it until Docker closes the stream.
+func hijackRequest(w http.ResponseWriter, req *http.Request, dial func() (net.Conn, error), addr string, path string) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		WriteError(w, http.StatusInternalServerError, "Connection hijacking is not supported")
+		return
+	}
+	backend, err := dial()
+	if err != nil {
+		WriteError(w, proxyErrorStatus(err), fmt.Sprintf("Error connecting to %s: %s", addr, err))
+		return
+	}
+	defer backend.Close()
+	r, err := http.NewRequest(req.Method, path, req.Body)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("Error making request to %s: %s", addr, err))
+		return
+	}
+	copyHeaders(req.Header, r.Header)
+	r.Host = req.Host
+	r.ContentLength = req.ContentLength
+	if err := r.Write(backend); err != nil {
+		WriteError(w, proxyErrorStatus(err), fmt.Sprintf("Error performing request to %s: %s", addr, err))
+		return
+	}
+	client, buf, err := hj.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection: %s", err)
+		return
+	}
+	defer client.Close()
+	// stdin ; buffered data is read before the underlying connection
+	go func() {
+		io.Copy(backend, buf)
+		closeWrite(backend)
+	}()
+	// stdout/stderr including the response headers from Docker
+	io.Copy(client, backend)
+}
+
+// Closes the write side of the connection if supported
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+	}
 }
 
 // Used from net/http/httputil/reverseproxy.go to handle underlying proxying
 func copyResponse(dst io.Writer, src io.Reader, flushInterval time.Duration) {
-	if flushInterval != 0 {
+	if flushInterval < 0 {
+		if wf, ok := dst.(writeFlusher); ok {
+			dst = &flushWriter{dst: wf}
+		}
+	} else if flushInterval != 0 {
 		if wf, ok := dst.(writeFlusher); ok {
 			mlw := &maxLatencyWriter{
 				dst:     wf,
@@ -123,6 +282,17 @@ type writeFlusher interface {
 	http.Flusher
 }
 
+// Flushes after every write
+type flushWriter struct {
+	dst writeFlusher
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.dst.Write(p)
+	f.dst.Flush()
+	return n, err
+}
+
 type maxLatencyWriter struct {
 	dst     writeFlusher
 	latency time.Duration
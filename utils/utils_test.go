@@ -16,9 +16,15 @@
 package utils
 
 import (
+	"encoding/json"
 	_ "log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCopyHeaders(t *testing.T) {
@@ -31,3 +37,99 @@ func TestCopyHeaders(t *testing.T) {
 		t.Fatalf("Error: expected foo in header. received: %s", hdr2)
 	}
 }
+
+func TestIsHijackRequest(t *testing.T) {
+	tests := map[string]bool{
+		"/v1.10/containers/abc/attach": true,
+		"/v1.10/exec/abc/start":        true,
+		"/v1.10/containers/abc/logs":   false,
+		"/v1.10/containers/json":       false,
+	}
+	for path, expected := range tests {
+		req, _ := http.NewRequest("POST", path, nil)
+		if isHijackRequest(req) != expected {
+			t.Fatalf("Error: expected hijack %v for %s", expected, path)
+		}
+	}
+	req, _ := http.NewRequest("POST", "/v1.10/containers/abc/start", nil)
+	req.Header.Set("Connection", "Upgrade")
+	if !isHijackRequest(req) {
+		t.Fatalf("Error: expected hijack for upgrade request")
+	}
+}
+
+func TestCopyResponseFlushesStreams(t *testing.T) {
+	rec := httptest.NewRecorder()
+	copyResponse(rec, strings.NewReader("foo"), -1)
+	if !rec.Flushed {
+		t.Fatalf("Error: expected response to be flushed")
+	}
+	if rec.Body.String() != "foo" {
+		t.Fatalf("Error: expected foo ; received: %s", rec.Body.String())
+	}
+}
+
+func TestProxyLocalDockerRequestUnavailable(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/v1.10/containers/json", nil)
+	rec := httptest.NewRecorder()
+	docker := NewDockerClient(&DockerEndpoint{Network: "unix", Addr: "/nonexistent/docker.sock"}, time.Second, time.Second)
+	ProxyLocalDockerRequest(rec, req, docker)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Non-expected status code %v: expected %v", rec.Code, http.StatusServiceUnavailable)
+	}
+	body := map[string]string{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("Error decoding error response: %s", err)
+	}
+	if body["message"] == "" {
+		t.Fatalf("Error: expected message in error response")
+	}
+}
+
+func TestProxyLocalDockerRequestCopiesHeaders(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Error listening on %s: %s", sock, err)
+	}
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	req, _ := http.NewRequest("POST", "/v1.10/containers/abc/start", strings.NewReader(`{"Binds": ["/data:/data"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Registry-Auth", "auth")
+	rec := httptest.NewRecorder()
+	docker := NewDockerClient(&DockerEndpoint{Network: "unix", Addr: sock}, time.Second, time.Second)
+	ProxyLocalDockerRequest(rec, req, docker)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Non-expected status code %v: expected %v", rec.Code, http.StatusNoContent)
+	}
+	hdr := <-headers
+	if hdr.Get("Content-Type") != "application/json" || hdr.Get("X-Registry-Auth") != "auth" {
+		t.Fatalf("Error: expected request headers to be proxied ; received: %v", hdr)
+	}
+}
+
+func TestProxyRemoteRequestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+	client := NodeClient
+	NodeClient = NewNodeClient(time.Second, 50*time.Millisecond)
+	defer func() { NodeClient = client }()
+	req, _ := http.NewRequest("GET", "/v1.10/containers/json", nil)
+	rec := httptest.NewRecorder()
+	ProxyRemoteRequest(rec, req, srv.URL)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Non-expected status code %v: expected %v", rec.Code, http.StatusGatewayTimeout)
+	}
+}